@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// S3 servers reject signed requests whose timestamp differs from their clock
+// by more than this.
+const s3SignatureTolerance = 15 * time.Minute
+
+// Skews above this are reported as a warning.
+const clockSkewWarning = time.Minute
+
+var errClockSkew = errors.New("client clock skew exceeds limit")
+
+// measureClockSkew returns how far the server's clock, from the Date header
+// of its response to a GET of url, is ahead of the local clock. The Date
+// header has one second resolution, so the result is only accurate to about
+// a second. Any response status is accepted.
+func measureClockSkew(client *http.Client, url string) (time.Duration, error) {
+	sent := time.Now()
+	resp, err := client.Get(url)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	received := time.Now()
+
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return 0, fmt.Errorf("no valid Date header in response from %s", url)
+	}
+	// Date is truncated to the second; compare its midpoint with the middle
+	// of the request.
+	local := sent.Add(received.Sub(sent) / 2)
+	return date.Add(500 * time.Millisecond).Sub(local), nil
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// checkClockSkew reports the skew against a server, warning if it is large
+// and returning errClockSkew if it exceeds limit.
+func checkClockSkew(name string, skew time.Duration, limit time.Duration) error {
+	skew = skew.Round(time.Second)
+	fmt.Printf("Clock skew with %s is %s.\n", name, skew)
+	if absDuration(skew) > limit {
+		return fmt.Errorf("[error] Clock skew of %s with %s exceeds %s, S3 requests would be rejected. Synchronize the client clock, for example with NTP: %w", skew, name, limit, errClockSkew)
+	}
+	if absDuration(skew) > clockSkewWarning {
+		fmt.Printf("WARNING. Client clock differs from %s by %s.\n", name, skew)
+	}
+	return nil
+}
+
+// ClockSkew returns how far the FlashBlade's clock is ahead of the local one.
+func (c *FlashBladeClient) ClockSkew() (time.Duration, error) {
+	return measureClockSkew(c.client, "https://"+c.Target+"/api/api_version")
+}
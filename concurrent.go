@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Data VIP choices for --concurrent-protocols.
+const concurrentSameVip = "same"
+const concurrentDifferentVip = "different"
+
+// concurrentNFSVip returns the data VIP that NFS is tested against while S3
+// is tested against s3Vip: the same VIP, or with different VIPs, the next one
+// in dataVips, which is an error if there is no other.
+func concurrentNFSVip(mode string, dataVips []string, s3Vip string) (string, error) {
+	if mode != concurrentDifferentVip {
+		return s3Vip, nil
+	}
+	for i, vip := range dataVips {
+		if next := dataVips[(i+1)%len(dataVips)]; vip == s3Vip && next != s3Vip {
+			return next, nil
+		}
+	}
+	return "", fmt.Errorf("[error] No data VIP other than %s to test NFS against.", s3Vip)
+}
+
+// runConcurrently runs an NFS and an S3 phase at the same time and returns
+// their results once both have finished.
+func runConcurrently(nfsPhase func() PhaseResult, s3Phase func() PhaseResult) (PhaseResult, PhaseResult) {
+	var wg sync.WaitGroup
+	var nfsResult, s3Result PhaseResult
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		nfsResult = nfsPhase()
+	}()
+	go func() {
+		defer wg.Done()
+		s3Result = s3Phase()
+	}()
+	wg.Wait()
+	return nfsResult, s3Result
+}
+
+// combinePhases adds up the throughput and failures of phases that ran at the
+// same time. Their latencies measure different operations and are not
+// combined.
+func combinePhases(phases ...PhaseResult) PhaseResult {
+	var combined PhaseResult
+	for _, p := range phases {
+		combined.BytesPerSec += p.BytesPerSec
+		combined.FailedOps += p.FailedOps
+		combined.FailedBytes += p.FailedBytes
+	}
+	return combined
+}
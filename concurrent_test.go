@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestConcurrentNFSVip(t *testing.T) {
+	vips := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}
+	for _, c := range []struct {
+		mode  string
+		vips  []string
+		s3Vip string
+		want  string
+	}{
+		{concurrentSameVip, vips, "10.0.0.2", "10.0.0.2"},
+		{concurrentDifferentVip, vips, "10.0.0.2", "10.0.0.3"},
+		{concurrentDifferentVip, vips, "10.0.0.3", "10.0.0.1"},
+		{concurrentSameVip, vips[:1], "10.0.0.1", "10.0.0.1"},
+	} {
+		got, err := concurrentNFSVip(c.mode, c.vips, c.s3Vip)
+		if err != nil || got != c.want {
+			t.Errorf("concurrentNFSVip(%s, %v, %s) = %s, %v, want %s", c.mode, c.vips, c.s3Vip, got, err, c.want)
+		}
+	}
+
+	// With different VIPs, there must be one other than the S3 VIP.
+	if got, err := concurrentNFSVip(concurrentDifferentVip, vips[:1], "10.0.0.1"); err == nil {
+		t.Errorf("concurrentNFSVip with a single VIP returned %s", got)
+	}
+	if got, err := concurrentNFSVip(concurrentDifferentVip, vips, "10.0.0.9"); err == nil {
+		t.Errorf("concurrentNFSVip with an unknown S3 VIP returned %s", got)
+	}
+}
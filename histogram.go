@@ -0,0 +1,140 @@
+package main
+
+import (
+	"math"
+	"math/bits"
+	"time"
+)
+
+// The histogram uses HDR-style log-linear buckets: values below 2^subBucketBits
+// nanoseconds get an exact bucket each, larger values are grouped by power of
+// two and then split linearly into halfSubBucketCount sub-buckets. This bounds
+// the relative error of any recorded value to under 1/64, about 1.6%.
+const subBucketBits = 7
+const subBucketCount = 1 << subBucketBits
+const halfSubBucketCount = subBucketCount / 2
+const histogramBucketCount = subBucketCount + (64-subBucketBits)*halfSubBucketCount
+
+// latencyHistogram records operation latencies. It is not safe for concurrent
+// use; each worker records into its own histogram and the results are merged
+// once the phase completes.
+type latencyHistogram struct {
+	counts [histogramBucketCount]uint64
+	total  uint64
+	sum    uint64
+	min    uint64
+	max    uint64
+}
+
+func newLatencyHistogram() *latencyHistogram {
+	return &latencyHistogram{min: math.MaxUint64}
+}
+
+func histogramIndex(v uint64) int {
+	mag := bits.Len64(v)
+	if mag <= subBucketBits {
+		return int(v)
+	}
+	shift := mag - subBucketBits
+	sub := int(v >> uint(shift))
+	return subBucketCount + (shift-1)*halfSubBucketCount + (sub - halfSubBucketCount)
+}
+
+// histogramValue returns the highest value that maps to the given bucket.
+func histogramValue(idx int) uint64 {
+	if idx < subBucketCount {
+		return uint64(idx)
+	}
+	shift := uint((idx-subBucketCount)/halfSubBucketCount + 1)
+	sub := uint64((idx-subBucketCount)%halfSubBucketCount + halfSubBucketCount)
+	return (sub << shift) + (1 << shift) - 1
+}
+
+func (h *latencyHistogram) Record(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	v := uint64(d)
+	h.counts[histogramIndex(v)]++
+	h.total++
+	h.sum += v
+	if v < h.min {
+		h.min = v
+	}
+	if v > h.max {
+		h.max = v
+	}
+}
+
+// RecordSince records the time elapsed since start.
+func (h *latencyHistogram) RecordSince(start time.Time) {
+	h.Record(time.Since(start))
+}
+
+func (h *latencyHistogram) Merge(o *latencyHistogram) {
+	for i, c := range o.counts {
+		h.counts[i] += c
+	}
+	h.total += o.total
+	h.sum += o.sum
+	if o.min < h.min {
+		h.min = o.min
+	}
+	if o.max > h.max {
+		h.max = o.max
+	}
+}
+
+func (h *latencyHistogram) Count() uint64 {
+	return h.total
+}
+
+// Percentile returns the latency at or below which q percent of the recorded
+// operations completed.
+func (h *latencyHistogram) Percentile(q float64) time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+	target := uint64(math.Ceil(q / 100 * float64(h.total)))
+	if target == 0 {
+		target = 1
+	}
+	seen := uint64(0)
+	for i, c := range h.counts {
+		seen += c
+		if seen >= target {
+			v := histogramValue(i)
+			if v > h.max {
+				v = h.max
+			}
+			return time.Duration(v)
+		}
+	}
+	return time.Duration(h.max)
+}
+
+// LatencySummary is the reported form of a latencyHistogram.
+type LatencySummary struct {
+	Count uint64        `json:"count"`
+	Mean  time.Duration `json:"mean_ns"`
+	P50   time.Duration `json:"p50_ns"`
+	P90   time.Duration `json:"p90_ns"`
+	P99   time.Duration `json:"p99_ns"`
+	P999  time.Duration `json:"p99_9_ns"`
+	Max   time.Duration `json:"max_ns"`
+}
+
+func (h *latencyHistogram) Summary() LatencySummary {
+	if h.total == 0 {
+		return LatencySummary{}
+	}
+	return LatencySummary{
+		Count: h.total,
+		Mean:  time.Duration(h.sum / h.total),
+		P50:   h.Percentile(50),
+		P90:   h.Percentile(90),
+		P99:   h.Percentile(99),
+		P999:  h.Percentile(99.9),
+		Max:   time.Duration(h.max),
+	}
+}
@@ -1,10 +1,17 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
 	"os"
 	"runtime"
+	"strconv"
+	"strings"
+	"time"
 )
 
 const testFilesystemName = "deleteme-go-plumbing"
@@ -20,10 +27,259 @@ func main() {
 	dataVipPtr := flag.String("datavip", "", "Remote IP address for data connections.")
 	filesystemPtr := flag.String("filesystem", "", "Remote filesystem for NFS testing. Default is to automatically create temporary filesystem.")
 	bucketPtr := flag.String("bucket", "", "Remote bucket for S3 testing. Default is to automatically create temporary bucket.")
+	posixPathPtr := flag.String("posix-path", "", "Also run the write and read tests with ordinary file IO in this directory of a locally mounted filesystem.")
+	sourceIPPtr := flag.String("source-ip", "", "Local address to originate data connections from. Default is to let the kernel choose.")
+	interfacePtr := flag.String("interface", "", "Local interface whose first IPv4 address data connections originate from.")
+	allInterfacesPtr := flag.Bool("all-interfaces", false, "Test each data VIP once from every local interface address that can reach it.")
+	nfsUidPtr := flag.Uint("nfs-uid", 1001, "User id sent with NFS requests.")
+	nfsGidPtr := flag.Uint("nfs-gid", 1001, "Primary group id sent with NFS requests.")
+	nfsGidsPtr := flag.String("nfs-gids", "", "Comma-separated supplementary group ids sent with NFS requests.")
+	nfsMachinePtr := flag.String("nfs-machine-name", "anon", "Machine name sent with NFS requests.")
+	nfsSubdirPtr := flag.String("nfs-subdir", "", "Directory within the export in which to create a per-run test directory. Default is to use the root of the export.")
+	nfsFileSizePtr := flag.Int("nfs-file-size", 0, "Size in MiB of each NFS test file. Default is unbounded, appending to one file per worker.")
+	nfsFilesPerWorkerPtr := flag.Int("nfs-files-per-worker", 1, "Number of NFS test files each worker cycles through, requires --nfs-file-size.")
+	nfsConnectionsPtr := flag.Int("nfs-connections", 0, "Number of NFS connections per data VIP shared by the NFS workers, like nconnect. Default is one connection per worker.")
+	nfsStabilityPtr := flag.String("nfs-write-stability", "unstable", "Issue NFS writes as \"unstable\" or \"file-sync\".")
+	nfsCommitEveryPtr := flag.Int("nfs-commit-every", 0, "With unstable NFS writes, issue a COMMIT after every this many MiB written and before closing each file.")
+	nfsRandomPtr := flag.Bool("nfs-random", false, "Also run the NFS random IO test.")
+	nfsRandomBlockPtr := flag.Int("nfs-random-bs", 4, "Block size in KiB for the NFS random IO test, from 4 to 1024.")
+	nfsRandomReadPctPtr := flag.Int("nfs-random-read-pct", 70, "Percentage of NFS random IO operations that are reads.")
+	nfsRandomWorkingSetPtr := flag.Int("nfs-random-working-set", 1024, "Total size in MiB of the files used by the NFS random IO test.")
+	nfsMetaPtr := flag.Bool("nfs-meta", false, "Also run the NFS metadata operations test.")
+	nfsMetaDirsPtr := flag.Int("nfs-meta-dirs", 10, "Directories created per worker by the NFS metadata test.")
+	nfsMetaFilesPtr := flag.Int("nfs-meta-files", 100, "Maximum number of files created per directory by the NFS metadata test.")
+	s3AccessKeyPtr := flag.String("s3-access-key", "", "S3 access key id for an existing bucket, requires --s3-secret-key-file.")
+	s3SecretKeyFilePtr := flag.String("s3-secret-key-file", "", "File containing the S3 secret access key.")
+	awsProfilePtr := flag.String("aws-profile", "", "Profile in the AWS shared credentials file to use for an existing bucket.")
+	awsCredentialsFilePtr := flag.String("aws-credentials-file", "", "Path of the AWS shared credentials file. Default is ~/.aws/credentials.")
+	s3SchemePtr := flag.String("s3-scheme", "http", "Scheme for S3 connections: http, https, or both to test each in turn.")
+	s3CABundlePtr := flag.String("s3-ca-bundle", "", "PEM file of CA certificates trusted for HTTPS, in addition to the system roots.")
+	s3InsecurePtr := flag.Bool("s3-insecure", false, "Skip verification of the S3 endpoint's HTTPS certificate.")
+	s3AddressingPtr := flag.String("s3-addressing", "path", "S3 bucket addressing style: path or virtual.")
+	s3RegionPtr := flag.String("s3-region", "us-east-1", "Region used to sign S3 requests.")
+	s3PortPtr := flag.Int("s3-port", 0, "Port of the S3 endpoint. Default is 80 for HTTP and 443 for HTTPS.")
+	maxClockSkewPtr := flag.Int("max-clock-skew", 900, "Largest client clock skew, in seconds, with an S3 endpoint before its tests are skipped.")
+	s3MaxConnsPtr := flag.Int("s3-max-conns", 0, "Maximum number of S3 connections per data VIP. Default is unlimited.")
+	s3IdleTimeoutPtr := flag.Int("s3-idle-timeout", 90, "Seconds an idle S3 connection is kept open for reuse.")
+	s3SocketBufferPtr := flag.Int("s3-socket-buffer", 0, "TCP send and receive buffer size in KiB for S3 connections. Default is the system default.")
+	s3DisableKeepAlivePtr := flag.Bool("s3-disable-keepalive", false, "Open a new S3 connection for every request.")
+	s3OpsPtr := flag.Bool("s3-ops", false, "Also run the S3 small-object operations test (PUT, GET, HEAD, DELETE).")
+	s3OpsKeysPtr := flag.Int("s3-ops-keys", 10000, "Number of keys used by the S3 small-object operations test.")
+	s3OpsSizesPtr := flag.String("s3-ops-sizes", "4,16,64,256", "Comma-separated object sizes in KiB for the S3 small-object operations test.")
+	s3RangedPtr := flag.Bool("s3-ranged", false, "Also run the S3 ranged GET test on the objects written by the write test.")
+	s3RangeSizePtr := flag.Int("s3-range-size", 64, "Size in KiB of each range read by the S3 ranged GET test.")
+	s3RangePatternPtr := flag.String("s3-range-pattern", rangePatternRandom, "Offsets read by the S3 ranged GET test: random or strided.")
+	s3RangeStridePtr := flag.Int("s3-range-stride", 0, "Distance in KiB between strided range reads. Default is the range size.")
+	s3MultipartPtr := flag.Bool("s3-multipart", false, "Also run the S3 large-object multipart upload test.")
+	s3MultipartSizePtr := flag.Int("s3-multipart-size", 4096, "Size in MiB of each object uploaded by the S3 multipart test.")
+	s3MultipartPartSizePtr := flag.Int("s3-multipart-part-size", 64, "Part size in MiB for the S3 multipart test.")
+	s3MultipartParallelPtr := flag.Int("s3-multipart-parallelism", 8, "Parts uploaded at once per object by the S3 multipart test.")
+	s3MultipartObjectsPtr := flag.Int("s3-multipart-objects", 1, "Objects uploaded at once by the S3 multipart test.")
+	s3ListPtr := flag.Bool("s3-list", false, "Also run the S3 LIST benchmark.")
+	s3ListKeysPtr := flag.Int("s3-list-keys", 50000, "Number of keys created for the S3 LIST benchmark.")
+	s3ListFanoutPtr := flag.Int("s3-list-fanout", 100, "Number of sub-prefixes the S3 LIST benchmark keys are spread across.")
+	s3ListMaxKeysPtr := flag.String("s3-list-max-keys", "100,1000", "Comma-separated max-keys values to measure in the S3 LIST benchmark.")
+	concurrentPtr := flag.String("concurrent-protocols", "", "Run the NFS and S3 write and read tests at the same time, against the \"same\" data VIP or \"different\" ones.")
+	mixedPtr := flag.Bool("mixed", false, "Also run the mixed read and write test for NFS and S3.")
+	mixedRatioPtr := flag.String("mixed-ratio", "70:30", "Ratio of reads to writes in the mixed test.")
+	verifyPtr := flag.Bool("verify", false, "Write self-describing data and verify every block read back.")
+	verifySeedPtr := flag.Uint64("verify-seed", 0, "Seed for the content written in verify mode. Default is a random seed.")
+	jsonPtr := flag.String("json", "", "Also write results, including latency percentiles, as JSON to this file.")
 	flag.Parse()
 
 	testDuration := *testDurationPtr
 
+	if *nfsUidPtr > math.MaxUint32 || *nfsGidPtr > math.MaxUint32 {
+		fmt.Println("ERROR. The --nfs-uid and --nfs-gid options must fit in 32 bits.")
+		os.Exit(1)
+	}
+	nfsGids, err := parseUint32List(*nfsGidsPtr)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if *nfsFileSizePtr < 0 || *nfsFilesPerWorkerPtr < 1 {
+		fmt.Println("ERROR. The --nfs-file-size option must not be negative and --nfs-files-per-worker must be positive.")
+		os.Exit(1)
+	}
+	if *nfsFilesPerWorkerPtr > 1 && *nfsFileSizePtr == 0 {
+		fmt.Println("ERROR. The --nfs-files-per-worker option requires --nfs-file-size.")
+		os.Exit(1)
+	}
+
+	nfsStability, err := parseWriteStability(*nfsStabilityPtr)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if *nfsCommitEveryPtr < 0 || (*nfsCommitEveryPtr > 0 && nfsStability != stabilityUnstable) {
+		fmt.Println("ERROR. The --nfs-commit-every option must not be negative and requires --nfs-write-stability unstable.")
+		os.Exit(1)
+	}
+
+	if *nfsConnectionsPtr < 0 {
+		fmt.Println("ERROR. The --nfs-connections option must not be negative.")
+		os.Exit(1)
+	}
+
+	if *nfsRandomBlockPtr < 4 || *nfsRandomBlockPtr > 1024 {
+		fmt.Println("ERROR. The --nfs-random-bs option must be between 4 and 1024 KiB.")
+		os.Exit(1)
+	}
+	if *nfsRandomReadPctPtr < 0 || *nfsRandomReadPctPtr > 100 {
+		fmt.Println("ERROR. The --nfs-random-read-pct option must be between 0 and 100.")
+		os.Exit(1)
+	}
+	if *nfsRandomWorkingSetPtr < 1 {
+		fmt.Println("ERROR. The --nfs-random-working-set option must be positive.")
+		os.Exit(1)
+	}
+
+	if *nfsMetaDirsPtr < 1 || *nfsMetaFilesPtr < 1 {
+		fmt.Println("ERROR. The --nfs-meta-dirs and --nfs-meta-files options must be positive.")
+		os.Exit(1)
+	}
+
+	if *maxClockSkewPtr < 1 {
+		fmt.Println("ERROR. The --max-clock-skew option must be positive.")
+		os.Exit(1)
+	}
+
+	if *s3MaxConnsPtr < 0 || *s3IdleTimeoutPtr < 1 || *s3SocketBufferPtr < 0 {
+		fmt.Println("ERROR. The --s3-max-conns and --s3-socket-buffer options must not be negative and --s3-idle-timeout must be positive.")
+		os.Exit(1)
+	}
+
+	var s3UseTLS []bool
+	switch *s3SchemePtr {
+	case "http":
+		s3UseTLS = []bool{false}
+	case "https":
+		s3UseTLS = []bool{true}
+	case "both":
+		s3UseTLS = []bool{false, true}
+	default:
+		fmt.Println("ERROR. The --s3-scheme option must be http, https or both.")
+		os.Exit(1)
+	}
+	if *s3AddressingPtr != "path" && *s3AddressingPtr != "virtual" {
+		fmt.Println("ERROR. The --s3-addressing option must be path or virtual.")
+		os.Exit(1)
+	}
+	if *s3PortPtr < 0 || *s3PortPtr > 65535 || (*s3PortPtr > 0 && len(s3UseTLS) > 1) {
+		fmt.Println("ERROR. The --s3-port option must be a valid port, and cannot be used with --s3-scheme both.")
+		os.Exit(1)
+	}
+	s3Port := "80"
+	if *s3PortPtr > 0 {
+		s3Port = strconv.Itoa(*s3PortPtr)
+	} else if s3UseTLS[0] {
+		s3Port = "443"
+	}
+
+	if (*s3AccessKeyPtr == "") != (*s3SecretKeyFilePtr == "") {
+		fmt.Println("ERROR. The --s3-access-key and --s3-secret-key-file options must be used together.")
+		os.Exit(1)
+	}
+	if *s3AccessKeyPtr != "" && (*awsProfilePtr != "" || *awsCredentialsFilePtr != "") {
+		fmt.Println("ERROR. The --s3-access-key option cannot be combined with --aws-profile or --aws-credentials-file.")
+		os.Exit(1)
+	}
+	s3AccessKey := *s3AccessKeyPtr
+	s3SecretKey := ""
+	if *s3SecretKeyFilePtr != "" {
+		secret, err := ioutil.ReadFile(*s3SecretKeyFilePtr)
+		if err != nil {
+			fmt.Println("ERROR. Unable to read --s3-secret-key-file.", err)
+			os.Exit(1)
+		}
+		s3SecretKey = strings.TrimSpace(string(secret))
+	}
+
+	if *concurrentPtr != "" && *concurrentPtr != concurrentSameVip && *concurrentPtr != concurrentDifferentVip {
+		fmt.Println("ERROR. The --concurrent-protocols option must be same or different.")
+		os.Exit(1)
+	}
+
+	mixedReadPct, err := parseRatio(*mixedRatioPtr)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	s3OpsSizes, err := parseKiBList(*s3OpsSizesPtr)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if *s3OpsKeysPtr < 1 {
+		fmt.Println("ERROR. The --s3-ops-keys option must be positive.")
+		os.Exit(1)
+	}
+	s3RangeSize := int64(*s3RangeSizePtr) * 1024
+	s3RangeStride := int64(*s3RangeStridePtr) * 1024
+	if s3RangeStride == 0 {
+		s3RangeStride = s3RangeSize
+	}
+	if *s3RangeSizePtr < 1 || s3RangeSize > testObjectSize || *s3RangeStridePtr < 0 {
+		fmt.Printf("ERROR. The --s3-range-size option must be between 1 and %d KiB and --s3-range-stride must not be negative.\n", testObjectSize/1024)
+		os.Exit(1)
+	}
+	if *s3RangePatternPtr != rangePatternRandom && *s3RangePatternPtr != rangePatternStrided {
+		fmt.Println("ERROR. The --s3-range-pattern option must be random or strided.")
+		os.Exit(1)
+	}
+
+	s3MultipartSize := uint64(*s3MultipartSizePtr) * 1024 * 1024
+	s3MultipartPartSize := uint64(*s3MultipartPartSizePtr) * 1024 * 1024
+	if *s3MultipartSizePtr < 1 || *s3MultipartParallelPtr < 1 || *s3MultipartObjectsPtr < 1 {
+		fmt.Println("ERROR. The --s3-multipart-size, --s3-multipart-parallelism and --s3-multipart-objects options must be positive.")
+		os.Exit(1)
+	}
+	if *s3MultipartPartSizePtr < 0 || s3MultipartPartSize < minPartSize || s3MultipartPartSize > maxPartSize {
+		fmt.Println("ERROR. The --s3-multipart-part-size option must be between 5 and 5120 MiB.")
+		os.Exit(1)
+	}
+	if (s3MultipartSize+s3MultipartPartSize-1)/s3MultipartPartSize > maxParts {
+		fmt.Printf("ERROR. The S3 multipart test objects would have more than %d parts, use a larger --s3-multipart-part-size.\n", maxParts)
+		os.Exit(1)
+	}
+
+	s3ListMaxKeys, err := parseIntList(*s3ListMaxKeysPtr)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if *s3ListKeysPtr < 1 || *s3ListFanoutPtr < 1 {
+		fmt.Println("ERROR. The --s3-list-keys and --s3-list-fanout options must be positive.")
+		os.Exit(1)
+	}
+
+	sourceModes := 0
+	for _, set := range []bool{*sourceIPPtr != "", *interfacePtr != "", *allInterfacesPtr} {
+		if set {
+			sourceModes++
+		}
+	}
+	if sourceModes > 1 {
+		fmt.Println("ERROR. Only one of --source-ip, --interface and --all-interfaces may be specified.")
+		os.Exit(1)
+	}
+	sourceIP := *sourceIPPtr
+	if sourceIP != "" && net.ParseIP(sourceIP) == nil {
+		fmt.Printf("ERROR. Invalid --source-ip address %s.\n", sourceIP)
+		os.Exit(1)
+	}
+	if *interfacePtr != "" {
+		sourceIP, err = sourceIPForInterface(*interfacePtr)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("Using source address %s of interface %s.\n", sourceIP, *interfacePtr)
+	}
+
 	mgmtVIP := os.Getenv("FB_MGMT_VIP")
 	fbtoken := os.Getenv("FB_TOKEN")
 
@@ -32,8 +288,11 @@ func main() {
 	fsName := *filesystemPtr
 	bucketName := *bucketPtr
 
+	// A run of only the local mount tests needs no FlashBlade access.
+	posixOnly := *posixPathPtr != "" && *skipNfsPtr && *skipS3Ptr
+
 	// If either filesystem or bucket manually specified, disable autoprovisioning.
-	autoProvision := fsName == "" && bucketName == ""
+	autoProvision := fsName == "" && bucketName == "" && !posixOnly
 
 	if !autoProvision && *dataVipPtr == "" && fsName != "" {
 		fmt.Println("ERROR. If testing an existing filesystem, must also specifiy --datavip option")
@@ -51,6 +310,19 @@ func main() {
 		*skipS3Ptr = *skipS3Ptr || bucketName == ""
 	}
 
+	if *concurrentPtr != "" && (*skipNfsPtr || *skipS3Ptr) {
+		fmt.Println("ERROR. The --concurrent-protocols option requires both NFS and S3 tests.")
+		os.Exit(1)
+	}
+	if *concurrentPtr != "" && (*mixedPtr || *nfsRandomPtr || *nfsMetaPtr || *s3OpsPtr || *s3RangedPtr || *s3MultipartPtr || *s3ListPtr) {
+		fmt.Println("ERROR. The --concurrent-protocols option runs only the write and read tests, and cannot be combined with --mixed, --nfs-random, --nfs-meta, --s3-ops, --s3-ranged, --s3-multipart or --s3-list.")
+		os.Exit(1)
+	}
+
+	if autoProvision && (*s3AccessKeyPtr != "" || *awsProfilePtr != "" || *awsCredentialsFilePtr != "") {
+		fmt.Println("ERROR. S3 credentials options apply only to an existing bucket set with --bucket; autoprovisioning creates its own access keys.")
+		os.Exit(1)
+	}
 	if autoProvision && mgmtVIP == "" {
 		fmt.Println("ERROR. Must set environment variable FB_MGMT_VIP to FlashBlade management VIP.")
 		os.Exit(1)
@@ -60,6 +332,31 @@ func main() {
 		os.Exit(1)
 	}
 
+	verifySeed := *verifySeedPtr
+	if *verifyPtr && verifySeed == 0 {
+		verifySeed = uint64(time.Now().UnixNano())
+	}
+	if *verifyPtr {
+		fmt.Printf("Verifying data read back, using seed %d.\n", verifySeed)
+	}
+
+	nfsOpts := NFSOptions{
+		Credentials: &NFSCredentials{
+			Uid:         uint32(*nfsUidPtr),
+			Gid:         uint32(*nfsGidPtr),
+			Gids:        nfsGids,
+			MachineName: *nfsMachinePtr,
+		},
+		Subdir:         *nfsSubdirPtr,
+		Verify:         *verifyPtr,
+		Seed:           verifySeed,
+		FileSize:       uint64(*nfsFileSizePtr) * 1024 * 1024,
+		FilesPerWorker: *nfsFilesPerWorkerPtr,
+		Stability:      nfsStability,
+		CommitBytes:    uint64(*nfsCommitEveryPtr) * 1024 * 1024,
+		Connections:    *nfsConnectionsPtr,
+	}
+
 	coreCount := runtime.NumCPU()
 	if coreCount < 12 {
 		fmt.Printf("WARNING. Found %d cores, recommend at least 12 cores to prevent client bottlenecks.\n", coreCount)
@@ -67,7 +364,6 @@ func main() {
 
 	// Begin Main application logic.
 	var c *FlashBladeClient
-	var err error
 
 	if autoProvision {
 		c, err = NewFlashBladeClient(mgmtVIP, fbtoken)
@@ -76,12 +372,24 @@ func main() {
 			os.Exit(1)
 		}
 		defer c.Close()
+
+		skew, err := c.ClockSkew()
+		if err != nil {
+			fmt.Println("Unable to measure clock skew with FlashBlade.", err)
+		} else if err := checkClockSkew("FlashBlade "+mgmtVIP, skew, time.Duration(*maxClockSkewPtr)*time.Second); err != nil {
+			// The data VIPs share the management API's clock, so every S3
+			// test would be skipped after provisioning its bucket.
+			fmt.Println(err)
+			if !*skipS3Ptr {
+				os.Exit(1)
+			}
+		}
 	}
 
 	var dataVips []string
 	if *dataVipPtr != "" {
 		dataVips = []string{*dataVipPtr}
-	} else {
+	} else if !posixOnly {
 		dataVips, err = c.GetOneDataInterfacePerSubnet()
 		if err != nil {
 			fmt.Println(err)
@@ -93,17 +401,66 @@ func main() {
 		fmt.Printf("Found %d subnets with data VIPs. Will test one VIP per subnet.\n", len(dataVips))
 	}
 
-	if len(dataVips) == 0 {
+	if len(dataVips) == 0 && !posixOnly {
 		fmt.Println("Found no data VIPs, unable to proceed.")
 		os.Exit(1)
 	}
+	if *concurrentPtr == concurrentDifferentVip && len(dataVips) < 2 {
+		fmt.Println("ERROR. Testing NFS and S3 against different data VIPs requires at least two data VIPs.")
+		os.Exit(1)
+	}
+
+	var targets []testTarget
+	if *allInterfacesPtr && !posixOnly {
+		localIPs, err := localSourceIPs()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		// Probe the ports of every protocol that will be tested.
+		var ports []string
+		if !*skipNfsPtr {
+			ports = append(ports, "2049")
+		}
+		if !*skipS3Ptr {
+			if *s3PortPtr > 0 {
+				ports = append(ports, s3Port)
+			} else {
+				for _, useTLS := range s3UseTLS {
+					if useTLS {
+						ports = append(ports, "443")
+					} else {
+						ports = append(ports, "80")
+					}
+				}
+			}
+		}
+		for _, dataVip := range dataVips {
+			for _, ip := range localIPs {
+				if canReach(ip, dataVip, ports...) {
+					targets = append(targets, testTarget{dataVip: dataVip, sourceIP: ip})
+				}
+			}
+		}
+		fmt.Printf("Found %d reachable pairs of local address and data VIP.\n", len(targets))
+		if len(targets) == 0 {
+			fmt.Println("No local address can reach any data VIP, unable to proceed.")
+			os.Exit(1)
+		}
+	} else {
+		for _, dataVip := range dataVips {
+			targets = append(targets, testTarget{dataVip: dataVip, sourceIP: sourceIP})
+		}
+	}
 
-	var results []string
+	var results []TestResult
 
 	// ===== NFS Tests =====
-	if *skipNfsPtr == false {
+	// With --concurrent-protocols, NFS is tested alongside S3 below.
+	if *skipNfsPtr == false && *concurrentPtr == "" {
 
-		for _, dataVip := range dataVips {
+		for _, target := range targets {
+			dataVip := target.dataVip
 
 			if autoProvision {
 				fs := FileSystem{Name: fsName}
@@ -119,27 +476,76 @@ func main() {
 			}
 
 			export := "/" + fsName
-			fmt.Printf("Mounting NFS export %s at %s\n", export, dataVip)
-			nfs, err := NewNFSTester(dataVip, export, hostname, coreCount*2, testDuration)
+			if target.sourceIP != "" {
+				fmt.Printf("Mounting NFS export %s at %s from %s\n", export, dataVip, target.sourceIP)
+			} else {
+				fmt.Printf("Mounting NFS export %s at %s\n", export, dataVip)
+			}
+			opts := nfsOpts
+			opts.SourceIP = target.sourceIP
+			nfs, err := NewNFSTester(dataVip, export, hostname, coreCount*2, testDuration, opts)
 
 			if err != nil {
 				fmt.Println(err)
 				if autoProvision {
 					c.DeleteFileSystem(fsName)
 				}
-				results = append(results, fmt.Sprintf("%s,nfs,MOUNT FAILED,-,-", dataVip))
+				results = append(results, TestResult{DataVip: dataVip, SourceIP: target.sourceIP, Protocol: "nfs", Result: "MOUNT FAILED"})
 				continue
 			}
 
 			fmt.Println("Running NFS write test.")
-			write_bytes_per_sec := nfs.WriteTest()
-			fmt.Printf("Write Throughput = %s\n", ByteRateSI(write_bytes_per_sec))
+			write := nfs.WriteTest()
+			reportPhase("Write", write)
+			commits, hasCommits := nfs.CommitResult()
+			if hasCommits {
+				reportOperation(commits)
+			}
 
 			fmt.Println("Running NFS read test.")
-			read_bytes_per_sec := nfs.ReadTest()
-			fmt.Printf("Read Throughput = %s\n", ByteRateSI(read_bytes_per_sec))
+			read := nfs.ReadTest()
+			reportPhase("Read", read)
+
+			result := TestResult{DataVip: dataVip, SourceIP: target.sourceIP, Protocol: "nfs", Result: "SUCCESS", Write: &write, Read: &read}
+
+			if hasCommits {
+				result.Operations = append(result.Operations, commits)
+			}
+
+			if *mixedPtr {
+				fmt.Printf("Running NFS mixed test with %s reads:writes.\n", *mixedRatioPtr)
+				mixed := nfs.MixedTest(mixedReadPct)
+				reportMixed(mixed)
+				result.Mixed = &mixed
+			}
+
+			if *nfsRandomPtr {
+				fmt.Printf("Running NFS random IO test with %d KiB blocks, %d%% reads.\n", *nfsRandomBlockPtr, *nfsRandomReadPctPtr)
+				randomResults := nfs.RandomIOTest(*nfsRandomBlockPtr*1024, *nfsRandomReadPctPtr, uint64(*nfsRandomWorkingSetPtr)*1024*1024)
+				for _, op := range randomResults {
+					reportOperation(op)
+				}
+				result.Operations = append(result.Operations, randomResults...)
+			}
 
-			results = append(results, fmt.Sprintf("%s,nfs,SUCCESS,%s,%s", dataVip, ByteRateSI(write_bytes_per_sec), ByteRateSI(read_bytes_per_sec)))
+			if *nfsMetaPtr {
+				fmt.Println("Running NFS metadata operations test.")
+				metaResults := nfs.MetadataTest(*nfsMetaDirsPtr, *nfsMetaFilesPtr)
+				for _, op := range metaResults {
+					reportOperation(op)
+				}
+				result.Operations = append(result.Operations, metaResults...)
+			}
+			results = append(results, result)
+
+			if !autoProvision {
+				// In manual mode, cleanup the files created.
+				err = nfs.Cleanup()
+				if err != nil {
+					fmt.Println(err)
+				}
+			}
+			nfs.Close()
 
 			if autoProvision {
 				err = c.DeleteFileSystem(fsName)
@@ -147,9 +553,41 @@ func main() {
 					fmt.Println(err)
 					os.Exit(1)
 				}
-			} else {
-				// In manual mode, cleanup the files created.
-				nfs.Cleanup()
+			}
+		}
+	}
+
+	// ===== POSIX Tests =====
+	if *posixPathPtr != "" {
+		posixOpts := POSIXOptions{Verify: nfsOpts.Verify, Seed: nfsOpts.Seed, FileSize: nfsOpts.FileSize, FilesPerWorker: nfsOpts.FilesPerWorker}
+		posix, err := NewPOSIXTester(*posixPathPtr, hostname, coreCount*2, testDuration, posixOpts)
+		if err != nil {
+			fmt.Println(err)
+			results = append(results, TestResult{DataVip: *posixPathPtr, Protocol: "posix", Result: "PATH FAILED"})
+		} else {
+			fmt.Printf("Testing local path %s on %s\n", *posixPathPtr, posix.MountDescription())
+
+			fmt.Println("Running POSIX write test.")
+			write := posix.WriteTest()
+			reportPhase("Write", write)
+			fsyncs, hasFsyncs := posix.FsyncResult()
+			if hasFsyncs {
+				reportOperation(fsyncs)
+			}
+
+			fmt.Println("Running POSIX read test.")
+			read := posix.ReadTest()
+			reportPhase("Read", read)
+
+			result := TestResult{DataVip: posix.DataVip(), Protocol: "posix", Result: "SUCCESS", Write: &write, Read: &read}
+			if hasFsyncs {
+				result.Operations = append(result.Operations, fsyncs)
+			}
+			results = append(results, result)
+
+			err = posix.Cleanup()
+			if err != nil {
+				fmt.Println(err)
 			}
 		}
 	}
@@ -159,8 +597,8 @@ func main() {
 
 		objAccountName := testObjectAccountName + "-" + hostname
 		objUserName := testObjectUserName + "-" + hostname
-		accessKey := ""
-		secretKey := ""
+		accessKey := s3AccessKey
+		secretKey := s3SecretKey
 
 		if autoProvision {
 
@@ -188,45 +626,211 @@ func main() {
 			secretKey = keys[0].SecretAccessKey
 		}
 
-		for _, dataVip := range dataVips {
+		for _, target := range targets {
+			for _, useTLS := range s3UseTLS {
+				dataVip := target.dataVip
+
+				s3Opts := S3Options{
+					Verify:             *verifyPtr,
+					Seed:               verifySeed,
+					SourceIP:           target.sourceIP,
+					MaxConnsPerHost:    *s3MaxConnsPtr,
+					IdleTimeout:        time.Duration(*s3IdleTimeoutPtr) * time.Second,
+					SocketBuffer:       *s3SocketBufferPtr * 1024,
+					DisableKeepAlives:  *s3DisableKeepAlivePtr,
+					UseTLS:             useTLS,
+					CABundle:           *s3CABundlePtr,
+					InsecureSkipVerify: *s3InsecurePtr,
+					VirtualHosted:      *s3AddressingPtr == "virtual",
+					Region:             *s3RegionPtr,
+					Port:               *s3PortPtr,
+					Profile:            *awsProfilePtr,
+					CredentialsFile:    *awsCredentialsFilePtr,
+					MaxClockSkew:       time.Duration(*maxClockSkewPtr) * time.Second,
+				}
+				protocol := s3ProtocolName(useTLS)
 
-			if autoProvision {
-				err = c.CreateObjectStoreBucket(bucketName, objAccountName)
+				if autoProvision {
+					err = c.CreateObjectStoreBucket(bucketName, objAccountName)
+					if err != nil {
+						fmt.Println(err)
+						os.Exit(1)
+					}
+				}
+
+				s3, err := NewS3Tester(dataVip, accessKey, secretKey, bucketName, hostname, coreCount, testDuration, s3Opts)
 				if err != nil {
 					fmt.Println(err)
-					os.Exit(1)
+					if autoProvision {
+						c.DeleteObjectStoreBucket(bucketName)
+					}
+					failure := "FAILED TO CONNECT"
+					if errors.Is(err, errClockSkew) {
+						failure = "CLOCK SKEW"
+					}
+					results = append(results, TestResult{DataVip: dataVip, SourceIP: target.sourceIP, Protocol: protocol, Result: failure})
+					continue
 				}
-			}
 
-			s3, err := NewS3Tester(dataVip, accessKey, secretKey, bucketName, hostname, coreCount, testDuration)
-			if err != nil {
-				fmt.Println(err)
-				if autoProvision {
-					c.DeleteObjectStoreBucket(bucketName)
+				if *concurrentPtr != "" {
+					nfsVip, err := concurrentNFSVip(*concurrentPtr, dataVips, dataVip)
+					if err != nil {
+						fmt.Println(err)
+						os.Exit(1)
+					}
+
+					if autoProvision {
+						fs := FileSystem{Name: fsName}
+						fs.Nfs.Enabled = true
+						fs.Nfs.V3Enabled = true
+
+						fmt.Println("Creating filesystem ", fsName)
+						err = c.CreateFileSystem(fs)
+						if err != nil {
+							fmt.Println(err)
+							os.Exit(1)
+						}
+					}
+
+					export := "/" + fsName
+					if target.sourceIP != "" {
+						fmt.Printf("Mounting NFS export %s at %s from %s\n", export, nfsVip, target.sourceIP)
+					} else {
+						fmt.Printf("Mounting NFS export %s at %s\n", export, nfsVip)
+					}
+					opts := nfsOpts
+					opts.SourceIP = target.sourceIP
+					nfs, err := NewNFSTester(nfsVip, export, hostname, coreCount*2, testDuration, opts)
+					if err != nil {
+						fmt.Println(err)
+						if autoProvision {
+							c.DeleteFileSystem(fsName)
+						}
+						results = append(results, TestResult{DataVip: nfsVip, SourceIP: target.sourceIP, Protocol: "nfs", Result: "MOUNT FAILED"})
+						fmt.Println("Running the S3 tests alone.")
+					}
+
+					if nfs != nil {
+						fmt.Printf("Running NFS write test against %s and S3 write test against %s at the same time.\n", nfsVip, dataVip)
+						nfsWrite, s3Write := runConcurrently(nfs.WriteTest, s3.WriteTest)
+						reportPhase("NFS Write", nfsWrite)
+						reportPhase("S3 Write", s3Write)
+						combinedWrite := combinePhases(nfsWrite, s3Write)
+						reportPhase("Combined Write", combinedWrite)
+
+						fmt.Printf("Running NFS read test against %s and S3 read test against %s at the same time.\n", nfsVip, dataVip)
+						nfsRead, s3Read := runConcurrently(nfs.ReadTest, s3.ReadTest)
+						reportPhase("NFS Read", nfsRead)
+						reportPhase("S3 Read", s3Read)
+						combinedRead := combinePhases(nfsRead, s3Read)
+						reportPhase("Combined Read", combinedRead)
+
+						combinedVip := dataVip
+						if nfsVip != dataVip {
+							combinedVip = nfsVip + "+" + dataVip
+						}
+						results = append(results,
+							TestResult{DataVip: nfsVip, SourceIP: target.sourceIP, Protocol: "nfs", Result: "CONCURRENT", Write: &nfsWrite, Read: &nfsRead},
+							TestResult{DataVip: dataVip, SourceIP: target.sourceIP, Protocol: protocol, Result: "CONCURRENT", Write: &s3Write, Read: &s3Read},
+							TestResult{DataVip: combinedVip, SourceIP: target.sourceIP, Protocol: "nfs+" + protocol, Result: "COMBINED", Write: &combinedWrite, Read: &combinedRead})
+
+						if !autoProvision {
+							err = nfs.Cleanup()
+							if err != nil {
+								fmt.Println(err)
+							}
+						}
+						nfs.Close()
+						if autoProvision {
+							err = c.DeleteFileSystem(fsName)
+							if err != nil {
+								fmt.Println(err)
+								os.Exit(1)
+							}
+						}
+
+						if autoProvision {
+							err = c.DeleteObjectStoreBucket(bucketName)
+							if err != nil {
+								fmt.Println(err)
+								os.Exit(1)
+							}
+						} else {
+							s3.Cleanup()
+						}
+						continue
+					}
 				}
-				results = append(results, fmt.Sprintf("%s,s3,FAILED TO CONNECT,-,-", dataVip))
-				continue
-			}
 
-			fmt.Println("Running S3 write test.")
-			write_bytes_per_sec := s3.WriteTest()
-			fmt.Printf("Write Throughput = %s\n", ByteRateSI(write_bytes_per_sec))
+				if useTLS {
+					fmt.Println("Running S3 write test over HTTPS.")
+				} else {
+					fmt.Println("Running S3 write test.")
+				}
+				write := s3.WriteTest()
+				reportPhase("Write", write)
 
-			fmt.Println("Running S3 read test.")
-			read_bytes_per_sec := s3.ReadTest()
-			fmt.Printf("Read Throughput = %s\n", ByteRateSI(read_bytes_per_sec))
+				fmt.Println("Running S3 read test.")
+				read := s3.ReadTest()
+				reportPhase("Read", read)
 
-			results = append(results, fmt.Sprintf("%s,s3,SUCCESS,%s,%s", dataVip, ByteRateSI(write_bytes_per_sec), ByteRateSI(read_bytes_per_sec)))
+				result := TestResult{DataVip: dataVip, SourceIP: target.sourceIP, Protocol: protocol, Result: "SUCCESS", Write: &write, Read: &read}
 
-			if autoProvision {
-				err = c.DeleteObjectStoreBucket(bucketName)
-				if err != nil {
-					fmt.Println(err)
-					os.Exit(1)
+				if *mixedPtr {
+					fmt.Printf("Running S3 mixed test with %s reads:writes.\n", *mixedRatioPtr)
+					mixed := s3.MixedTest(mixedReadPct)
+					reportMixed(mixed)
+					result.Mixed = &mixed
+				}
+
+				if *s3OpsPtr {
+					fmt.Printf("Running S3 small-object operations test with %d keys.\n", *s3OpsKeysPtr)
+					result.Operations = s3.SmallObjectTest(*s3OpsKeysPtr, s3OpsSizes)
+					for _, op := range result.Operations {
+						reportOperation(op)
+					}
+				}
+
+				if *s3RangedPtr {
+					fmt.Printf("Running S3 ranged GET test with %d KiB ranges.\n", *s3RangeSizePtr)
+					ranged, rangedOp := s3.RangedReadTest(s3RangeSize, s3RangeStride, *s3RangePatternPtr)
+					reportPhase("Ranged Read", ranged)
+					reportOperation(rangedOp)
+					result.RangedRead = &ranged
+					result.Operations = append(result.Operations, rangedOp)
+				}
+
+				if *s3MultipartPtr {
+					fmt.Printf("Running S3 multipart test with %d objects of %d MiB in %d MiB parts.\n", *s3MultipartObjectsPtr, *s3MultipartSizePtr, *s3MultipartPartSizePtr)
+					multipart, multipartResults := s3.MultipartTest(s3MultipartSize, s3MultipartPartSize, *s3MultipartParallelPtr, *s3MultipartObjectsPtr)
+					reportPhase("Multipart", multipart)
+					for _, op := range multipartResults {
+						reportOperation(op)
+					}
+					result.Multipart = &multipart
+					result.Operations = append(result.Operations, multipartResults...)
+				}
+
+				if *s3ListPtr {
+					fmt.Println("Running S3 LIST benchmark.")
+					listResults := s3.ListTest(*s3ListKeysPtr, *s3ListFanoutPtr, s3ListMaxKeys)
+					for _, op := range listResults {
+						reportOperation(op)
+					}
+					result.Operations = append(result.Operations, listResults...)
+				}
+				results = append(results, result)
+
+				if autoProvision {
+					err = c.DeleteObjectStoreBucket(bucketName)
+					if err != nil {
+						fmt.Println(err)
+						os.Exit(1)
+					}
+				} else {
+					// In manual mode, cleanup the objects created.
+					s3.Cleanup()
 				}
-			} else {
-				// In manual mode, cleanup the objects created.
-				s3.Cleanup()
 			}
 		}
 
@@ -254,8 +858,27 @@ func main() {
 		}
 	}
 
-	fmt.Println("\ndataVip,protocol,result,write_tput,read_tput")
+	fmt.Println("\n" + resultsHeader)
 	for _, r := range results {
 		fmt.Println(r)
 	}
+
+	var opRows []string
+	for _, r := range results {
+		opRows = append(opRows, r.operationRows()...)
+	}
+	if len(opRows) > 0 {
+		fmt.Println("\n" + operationsHeader)
+		for _, row := range opRows {
+			fmt.Println(row)
+		}
+	}
+
+	if *jsonPtr != "" {
+		err = writeResultsJSON(*jsonPtr, results)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
 }
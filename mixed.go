@@ -0,0 +1,44 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// mixedCounters accumulates the reads and writes of a mixed phase, which are
+// reported as separate phases although they run at the same time.
+type mixedCounters struct {
+	mu               sync.Mutex
+	readLatency      *latencyHistogram
+	writeLatency     *latencyHistogram
+	bytesRead        uint64
+	bytesWritten     uint64
+	failedReads      uint64
+	failedWrites     uint64
+	failedWriteBytes uint64
+}
+
+func newMixedCounters() *mixedCounters {
+	return &mixedCounters{readLatency: newLatencyHistogram(), writeLatency: newLatencyHistogram()}
+}
+
+// merge adds one worker's counters, which are not shared while it runs.
+func (c *mixedCounters) merge(w *mixedCounters) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readLatency.Merge(w.readLatency)
+	c.writeLatency.Merge(w.writeLatency)
+	c.bytesRead += w.bytesRead
+	c.bytesWritten += w.bytesWritten
+	c.failedReads += w.failedReads
+	c.failedWrites += w.failedWrites
+	c.failedWriteBytes += w.failedWriteBytes
+}
+
+func (c *mixedCounters) result(readPercent int, elapsed time.Duration) MixedResult {
+	read := newPhaseResult(c.bytesRead, c.failedReads, 0, c.readLatency, 1)
+	read.BytesPerSec = float64(c.bytesRead) / elapsed.Seconds()
+	write := newPhaseResult(c.bytesWritten, c.failedWrites, c.failedWriteBytes, c.writeLatency, 1)
+	write.BytesPerSec = float64(c.bytesWritten) / elapsed.Seconds()
+	return MixedResult{ReadPercent: readPercent, Read: read, Write: write}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// testTarget is a data VIP to test, optionally from a specific local source
+// address.
+type testTarget struct {
+	dataVip  string
+	sourceIP string
+}
+
+// newBoundDialer returns a dialer whose connections originate from sourceIP,
+// or from the address the kernel picks if sourceIP is empty.
+func newBoundDialer(sourceIP string) *net.Dialer {
+	d := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if sourceIP != "" {
+		d.LocalAddr = &net.TCPAddr{IP: net.ParseIP(sourceIP)}
+	}
+	return d
+}
+
+// interfaceAddrs returns the IPv4 addresses of an interface followed by its
+// IPv6 addresses. Link-local IPv6 addresses are left out, as they cannot be
+// used without naming the interface.
+func interfaceAddrs(iface net.Interface) []string {
+	var ipv4, ipv6 []string
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil
+	}
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		switch {
+		case !ok:
+		case ipnet.IP.To4() != nil:
+			ipv4 = append(ipv4, ipnet.IP.String())
+		case !ipnet.IP.IsLinkLocalUnicast():
+			ipv6 = append(ipv6, ipnet.IP.String())
+		}
+	}
+	return append(ipv4, ipv6...)
+}
+
+// sourceIPForInterface returns the first address of the named interface,
+// preferring IPv4.
+func sourceIPForInterface(name string) (string, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return "", err
+	}
+	ips := interfaceAddrs(*iface)
+	if len(ips) == 0 {
+		return "", fmt.Errorf("[error] Interface %s has no IPv4 or IPv6 address.", name)
+	}
+	return ips[0], nil
+}
+
+// localSourceIPs returns the addresses of all local interfaces that are up,
+// excluding loopback.
+func localSourceIPs() ([]string, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var ips []string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		ips = append(ips, interfaceAddrs(iface)...)
+	}
+	return ips, nil
+}
+
+// canReach reports whether TCP connections from sourceIP to all of the given
+// ports on dataVip succeed.
+func canReach(sourceIP string, dataVip string, ports ...string) bool {
+	d := newBoundDialer(sourceIP)
+	d.Timeout = 2 * time.Second
+	for _, port := range ports {
+		conn, err := d.Dial("tcp", net.JoinHostPort(dataVip, port))
+		if err != nil {
+			return false
+		}
+		conn.Close()
+	}
+	return true
+}
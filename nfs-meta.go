@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// metaWorker holds one worker's connection and the handles it has learned for
+// its own directory tree during the metadata test.
+type metaWorker struct {
+	conn   *nfsConn
+	client *nfsClient
+	root   string
+	rootFH []byte
+
+	dirFHs [][]byte
+
+	// files are the indexes of the files created, with each file's handle
+	// and whether it currently has its renamed name, while removed counts
+	// the files removed from the start of files.
+	files   []int
+	fileFHs [][]byte
+	renamed []bool
+	removed int
+}
+
+func generateMetaRoot(prefix string, i int) string {
+	return "meta-" + prefix + "-" + strconv.Itoa(i)
+}
+
+func metaDirName(d int) string {
+	return "dir-" + strconv.Itoa(d)
+}
+
+func metaFileName(i int) string {
+	return "file-" + strconv.Itoa(i)
+}
+
+// fileName returns the current name of the k-th created file.
+func (w *metaWorker) fileName(k int) string {
+	if w.renamed[k] {
+		return metaFileName(w.files[k]) + ".renamed"
+	}
+	return metaFileName(w.files[k])
+}
+
+// cleanup removes whatever is left of the worker's tree, after a failure or
+// an incomplete REMOVE or RMDIR phase.
+func (w *metaWorker) cleanup(n *NFSTester, dirs int) {
+	for k := w.removed; k < len(w.files); k++ {
+		w.client.remove(w.dirFHs[w.files[k]%dirs], w.fileName(k))
+	}
+	for d, fh := range w.dirFHs {
+		if fh != nil {
+			w.client.rmdir(w.rootFH, metaDirName(d))
+		}
+	}
+	w.client.rmdir(n.dirFH, w.root)
+}
+
+// runMetaPhase calls op on each worker in parallel, with i counting up from
+// zero, and reports the combined operation rate. Each worker stops after
+// limit(w) calls if limit is set, and when the test duration has passed if
+// timed is set.
+func (n *NFSTester) runMetaPhase(name string, workers []*metaWorker, timed bool, limit func(w *metaWorker) int, op func(w *metaWorker, i int) error) OperationResult {
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	latency := newLatencyHistogram()
+	ops := uint64(0)
+	failed_ops := uint64(0)
+
+	start := time.Now()
+	deadline := start.Add(time.Duration(n.durationSeconds) * time.Second)
+	for _, w := range workers {
+		wg.Add(1)
+		go func(w *metaWorker) {
+			defer wg.Done()
+			h := newLatencyHistogram()
+			done, failed := uint64(0), uint64(0)
+
+			for i := 0; (limit == nil || i < limit(w)) && (!timed || time.Now().Before(deadline)); i++ {
+				opStart := time.Now()
+				err := op(w, i)
+				if err != nil {
+					if failed == 0 {
+						fmt.Printf("NFS %s in %s failed: %v\n", name, w.root, err)
+					}
+					failed++
+					continue
+				}
+				h.RecordSince(opStart)
+				done++
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			latency.Merge(h)
+			ops += done
+			failed_ops += failed
+		}(w)
+	}
+	wg.Wait()
+
+	return newOperationResult(name, ops, failed_ops, latency, time.Since(start))
+}
+
+// MetadataTest measures metadata operation rates. Each worker builds its own
+// tree of dirsPerWorker directories, creating files in them for the test
+// duration or until each holds filesPerDir. It then runs LOOKUP, GETATTR,
+// SETATTR, READDIRPLUS and RENAME over the tree as fast as possible for the
+// test duration each, and finally times REMOVE and RMDIR of the whole tree.
+// Every operation is a single call naming an entry within a directory whose
+// handle is already known. Whatever is left of the trees is removed
+// afterwards, including when a phase fails.
+func (n *NFSTester) MetadataTest(dirsPerWorker int, filesPerDir int) []OperationResult {
+
+	var workers []*metaWorker
+	defer func() {
+		for _, w := range workers {
+			w.cleanup(n, dirsPerWorker)
+		}
+	}()
+
+	for i := 1; i <= n.concurrency; i++ {
+		c := n.conn(i)
+		root := generateMetaRoot(n.uniqueId, i)
+		fh, err := c.client.mkdir(n.dirFH, root, 0755)
+		if err != nil {
+			fmt.Printf("Unable to create %s: %v\n", root, err)
+			return nil
+		}
+		workers = append(workers, &metaWorker{conn: c, client: c.client, root: root, rootFH: fh, dirFHs: make([][]byte, dirsPerWorker)})
+	}
+
+	dirOf := func(w *metaWorker, k int) []byte {
+		return w.dirFHs[w.files[k]%dirsPerWorker]
+	}
+	allDirs := func(w *metaWorker) int { return dirsPerWorker }
+	created := func(w *metaWorker) int { return len(w.files) }
+
+	var results []OperationResult
+	run := func(name string, timed bool, limit func(w *metaWorker) int, op func(w *metaWorker, i int) error) {
+		results = append(results, n.runMetaPhase(name, workers, timed, limit, op))
+	}
+
+	run("MKDIR", false, allDirs, func(w *metaWorker, d int) error {
+		fh, err := w.client.mkdir(w.rootFH, metaDirName(d), 0755)
+		w.dirFHs[d] = fh
+		return err
+	})
+	for _, w := range workers {
+		for _, fh := range w.dirFHs {
+			if fh == nil {
+				fmt.Println("[error] Unable to run NFS metadata test, not all directories were created.")
+				return results
+			}
+		}
+	}
+
+	// Files are spread round-robin over the directories.
+	run("CREATE", true, func(w *metaWorker) int { return dirsPerWorker * filesPerDir }, func(w *metaWorker, i int) error {
+		fh, err := w.client.create(w.dirFHs[i%dirsPerWorker], metaFileName(i), 0644)
+		if err != nil {
+			return err
+		}
+		w.files = append(w.files, i)
+		w.fileFHs = append(w.fileFHs, fh)
+		w.renamed = append(w.renamed, false)
+		return nil
+	})
+	for _, w := range workers {
+		if len(w.files) == 0 {
+			fmt.Println("[error] Unable to run NFS metadata test, no files were created.")
+			return results
+		}
+	}
+
+	run("LOOKUP", true, nil, func(w *metaWorker, i int) error {
+		k := i % len(w.files)
+		_, err := w.client.lookup(dirOf(w, k), w.fileName(k))
+		return err
+	})
+	run("GETATTR", true, nil, func(w *metaWorker, i int) error {
+		_, err := w.client.getattr(w.fileFHs[i%len(w.files)])
+		return err
+	})
+	run("SETATTR", true, nil, func(w *metaWorker, i int) error {
+		// Alternate modes so that every call changes the file.
+		return w.client.setMode(w.fileFHs[i%len(w.files)], uint32(0600|(i/len(w.files)%2)<<5))
+	})
+	run("READDIRPLUS", true, nil, func(w *metaWorker, i int) error {
+		_, err := w.client.readdirplusFirst(w.dirFHs[i%dirsPerWorker])
+		return err
+	})
+	// Files are renamed back and forth on successive passes.
+	run("RENAME", true, nil, func(w *metaWorker, i int) error {
+		k := i % len(w.files)
+		from := w.fileName(k)
+		w.renamed[k] = !w.renamed[k]
+		err := w.client.rename(dirOf(w, k), from, w.fileName(k))
+		if err != nil {
+			w.renamed[k] = !w.renamed[k]
+		}
+		return err
+	})
+	run("REMOVE", false, created, func(w *metaWorker, k int) error {
+		err := w.client.remove(dirOf(w, k), w.fileName(k))
+		if err == nil && k == w.removed {
+			w.removed++
+		}
+		return err
+	})
+	run("RMDIR", false, allDirs, func(w *metaWorker, d int) error {
+		err := w.client.rmdir(w.rootFH, metaDirName(d))
+		if err == nil {
+			w.dirFHs[d] = nil
+		}
+		return err
+	})
+
+	return results
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// mixedBlockSize is the size of each read and write of the NFS mixed test.
+const mixedBlockSize = 1024 * 1024
+
+// mixedFile is a file of the write test's working set and its size in blocks.
+type mixedFile struct {
+	name   string
+	blocks int64
+}
+
+func (n *NFSTester) mixedWorker(conn *nfsConn, working []mixedFile, readPercent int, c *mixedCounters) {
+
+	defer n.wg.Done()
+
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	buf := make([]byte, mixedBlockSize)
+	rng.Read(buf)
+	w := newMixedCounters()
+
+	files := make(map[string][]byte)
+	defer c.merge(w)
+
+	for atomic.LoadInt32(&n.atm_finished) == 0 {
+		mf := working[rng.Intn(len(working))]
+		offset := rng.Int63n(mf.blocks) * mixedBlockSize
+		isRead := rng.Intn(100) < readPercent
+
+		// Writes overwrite existing blocks, so files keep their size and
+		// reads anywhere in the working set find data.
+		start := time.Now()
+		fh, ok := files[mf.name]
+		var err error
+		if !ok {
+			fh, err = conn.client.lookup(n.dirFH, mf.name)
+			if err == nil {
+				files[mf.name] = fh
+			}
+		}
+		count := 0
+		if err == nil {
+			if isRead {
+				count, _, err = n.readAt(conn.client, fh, uint64(offset), buf)
+				if err == nil && count < len(buf) {
+					err = io.ErrUnexpectedEOF
+				}
+			} else {
+				count, err = n.writeDirect(conn.client, fh, uint64(offset), buf, nil)
+			}
+		}
+
+		switch {
+		case isRead && err != nil:
+			w.failedReads++
+		case isRead:
+			w.readLatency.RecordSince(start)
+			w.bytesRead += uint64(count)
+		case err != nil:
+			w.failedWrites++
+			w.failedWriteBytes += uint64(count)
+		default:
+			w.writeLatency.RecordSince(start)
+			w.bytesWritten += uint64(count)
+		}
+		if err != nil {
+			// Look the file up again rather than reusing a handle in an
+			// unknown state, including one just looked up.
+			delete(files, mf.name)
+		}
+	}
+}
+
+// MixedTest reads and overwrites 1 MiB blocks at random offsets of the files
+// written by the write test, all workers sharing the whole working set, with
+// readPercent of operations being reads. Reads and writes are reported as
+// separate phases.
+func (n *NFSTester) MixedTest(readPercent int) MixedResult {
+
+	if n.filesWritten == 0 {
+		fmt.Println("[error] Unable to perform MixedTest, no files written.")
+		return MixedResult{ReadPercent: readPercent}
+	}
+
+	var working []mixedFile
+	c := n.conns[0]
+	for i := 1; i <= n.filesWritten; i++ {
+		fname := generateTestFilename("", n.uniqueId, i)
+		fh, err := c.client.lookup(n.dirFH, fname)
+		var attr fattr3
+		if err == nil {
+			attr, err = c.client.getattr(fh)
+		}
+		if err == nil && attr.size >= mixedBlockSize {
+			working = append(working, mixedFile{name: fname, blocks: int64(attr.size / mixedBlockSize)})
+		}
+	}
+	if len(working) == 0 {
+		fmt.Println("[error] Unable to perform MixedTest, no written files are at least 1 MiB.")
+		return MixedResult{ReadPercent: readPercent}
+	}
+
+	counters := newMixedCounters()
+	atomic.StoreInt32(&n.atm_finished, 0)
+	for i := 1; i <= n.concurrency; i++ {
+		n.wg.Add(1)
+		go n.mixedWorker(n.conn(i), working, readPercent, counters)
+	}
+	start := time.Now()
+	time.Sleep(time.Duration(n.durationSeconds) * time.Second)
+	atomic.StoreInt32(&n.atm_finished, 1)
+	n.wg.Wait()
+
+	return counters.result(readPercent, time.Since(start))
+}
@@ -0,0 +1,47 @@
+package main
+
+// nfsConn is one TCP connection to the NFS server, shared by the workers
+// assigned to it, as with the nconnect mount option. Their calls take turns
+// on the connection, which is redialed if a call fails on it.
+type nfsConn struct {
+	client *nfsClient
+}
+
+// mount looks up the export's root handle with MOUNT and opens count
+// connections to the NFS service, closing any already opened if one fails.
+// Every connection, including those to the portmapper and MOUNT, is dialed
+// from the source address if one is set.
+func (n *NFSTester) mount(count int) error {
+	rootFH, err := mountExport(n.opts.SourceIP, n.nfshost, n.export, n.cred)
+	if err != nil {
+		return err
+	}
+	addr, err := serviceAddr(n.opts.SourceIP, n.nfshost, nfs3Prog, nfs3Vers)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < count; i++ {
+		client, err := newNFSClient(n.opts.SourceIP, addr, n.cred)
+		if err != nil {
+			n.Close()
+			return err
+		}
+		n.conns = append(n.conns, &nfsConn{client: client})
+	}
+	n.rootFH = rootFH
+	return nil
+}
+
+// conn returns the connection used by worker i, numbered from 1. Workers are
+// spread round-robin over the connections.
+func (n *NFSTester) conn(i int) *nfsConn {
+	return n.conns[(i-1)%len(n.conns)]
+}
+
+// Close closes all of the tester's connections.
+func (n *NFSTester) Close() {
+	for _, c := range n.conns {
+		c.client.Close()
+	}
+	n.conns = nil
+}
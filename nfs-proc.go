@@ -0,0 +1,518 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/joshuarobinson/go-nfs-client/nfs/rpc"
+)
+
+// NFSv3 procedures (RFC 1813) used by the tests.
+const nfsProc3Getattr = 1
+const nfsProc3Setattr = 2
+const nfsProc3Lookup = 3
+const nfsProc3Read = 6
+const nfsProc3Write = 7
+const nfsProc3Create = 8
+const nfsProc3Mkdir = 9
+const nfsProc3Remove = 12
+const nfsProc3Rmdir = 13
+const nfsProc3Rename = 14
+const nfsProc3Readdirplus = 17
+const nfsProc3Fsinfo = 19
+const nfsProc3Commit = 21
+
+// stable_how values for WRITE.
+const nfs3Unstable = 0
+const nfs3DataSync = 1
+const nfs3FileSync = 2
+
+// nfs3Error is an nfsstat3 other than NFS3_OK.
+type nfs3Error uint32
+
+const (
+	nfs3ErrPerm     nfs3Error = 1
+	nfs3ErrNoent    nfs3Error = 2
+	nfs3ErrIO       nfs3Error = 5
+	nfs3ErrAcces    nfs3Error = 13
+	nfs3ErrExist    nfs3Error = 17
+	nfs3ErrNotdir   nfs3Error = 20
+	nfs3ErrIsdir    nfs3Error = 21
+	nfs3ErrInval    nfs3Error = 22
+	nfs3ErrNospc    nfs3Error = 28
+	nfs3ErrRofs     nfs3Error = 30
+	nfs3ErrNotempty nfs3Error = 66
+	nfs3ErrStale    nfs3Error = 70
+)
+
+func (e nfs3Error) Error() string {
+	switch e {
+	case nfs3ErrPerm:
+		return "NFS3ERR_PERM: not owner"
+	case nfs3ErrNoent:
+		return "NFS3ERR_NOENT: no such file or directory"
+	case nfs3ErrIO:
+		return "NFS3ERR_IO: I/O error"
+	case nfs3ErrAcces:
+		return "NFS3ERR_ACCES: permission denied"
+	case nfs3ErrExist:
+		return "NFS3ERR_EXIST: file exists"
+	case nfs3ErrNotdir:
+		return "NFS3ERR_NOTDIR: not a directory"
+	case nfs3ErrIsdir:
+		return "NFS3ERR_ISDIR: is a directory"
+	case nfs3ErrInval:
+		return "NFS3ERR_INVAL: invalid argument"
+	case nfs3ErrNospc:
+		return "NFS3ERR_NOSPC: no space left on device"
+	case nfs3ErrRofs:
+		return "NFS3ERR_ROFS: read-only file system"
+	case nfs3ErrNotempty:
+		return "NFS3ERR_NOTEMPTY: directory not empty"
+	case nfs3ErrStale:
+		return "NFS3ERR_STALE: stale file handle"
+	}
+	return fmt.Sprintf("NFS3 error %d", uint32(e))
+}
+
+// nfsClient issues NFSv3 calls with fixed credentials on one connection to
+// the NFS service. Calls take turns on the connection, as rpc.Client handles
+// one call at a time. A call that fails on the connection closes it, and the
+// next call redials it, so that one failure does not fail every later call.
+type nfsClient struct {
+	sourceIP string
+	addr     string
+	auth     rpc.Auth
+
+	mu   sync.Mutex
+	conn *rpc.Client
+	// redialAt is the earliest time to dial again after a failed dial, so
+	// that calls do not spin on an unreachable server.
+	redialAt time.Time
+}
+
+// redialInterval is the least time between failed dials of a connection.
+const redialInterval = time.Second
+
+// newNFSClient dials the NFS service at addr, from sourceIP if set.
+func newNFSClient(sourceIP string, addr string, auth rpc.Auth) (*nfsClient, error) {
+	conn, err := dialRPC(sourceIP, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &nfsClient{sourceIP: sourceIP, addr: addr, auth: auth, conn: conn}, nil
+}
+
+func (c *nfsClient) header(proc uint32) rpc.Header {
+	return rpcHeader(nfs3Prog, nfs3Vers, proc, c.auth)
+}
+
+// call issues an NFSv3 call and checks the nfsstat3 at the start of the
+// reply, returning the rest of a successful reply.
+func (c *nfsClient) call(args interface{}) (*xdrReader, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		if wait := time.Until(c.redialAt); wait > 0 {
+			time.Sleep(wait)
+		}
+		conn, err := dialRPC(c.sourceIP, c.addr)
+		if err != nil {
+			c.redialAt = time.Now().Add(redialInterval)
+			return nil, err
+		}
+		c.conn = conn
+	}
+
+	res, err := rpcCall(c.conn, args)
+	if err != nil {
+		c.conn.Close()
+		c.conn = nil
+		return nil, err
+	}
+	status := res.uint32()
+	if res.err != nil {
+		return nil, res.err
+	}
+	if status != 0 {
+		return nil, nfs3Error(status)
+	}
+	return res, nil
+}
+
+func (c *nfsClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
+
+// fattr3 holds the file attributes the tests use.
+type fattr3 struct {
+	ftype uint32
+	mode  uint32
+	size  uint64
+}
+
+// Encoded sizes of wcc_attr and fattr3.
+const wccAttrSize = 24
+const fattr3Size = 84
+
+func readFattr3(r *xdrReader) fattr3 {
+	var a fattr3
+	a.ftype = r.uint32()
+	a.mode = r.uint32()
+	r.skip(12) // nlink, uid, gid
+	a.size = r.uint64()
+	r.skip(fattr3Size - 28)
+	return a
+}
+
+// skipOptional skips an XDR optional value of the given size.
+func skipOptional(r *xdrReader, size int) {
+	if r.bool() {
+		r.skip(size)
+	}
+}
+
+// skipWccData skips the wcc_data at the start of WRITE and COMMIT replies.
+func skipWccData(r *xdrReader) {
+	skipOptional(r, wccAttrSize)
+	skipOptional(r, fattr3Size)
+}
+
+// sattr3 encodes an sattr3 that sets only the mode, and the mtime to the
+// server's time if SetMtime is 1 (SET_TO_SERVER_TIME). Each discriminant is
+// an XDR bool.
+type sattr3 struct {
+	SetMode  uint32
+	Mode     uint32
+	SetUid   uint32
+	SetGid   uint32
+	SetSize  uint32
+	SetAtime uint32
+	SetMtime uint32
+}
+
+func sattrMode(mode uint32) sattr3 {
+	return sattr3{SetMode: 1, Mode: mode}
+}
+
+const setToServerTime = 1
+
+type fhArgs struct {
+	rpc.Header
+	FH []byte
+}
+
+// diropArgs encodes diropargs3, a name within a directory.
+type diropArgs struct {
+	rpc.Header
+	Dir  []byte
+	Name string
+}
+
+func (c *nfsClient) getattr(fh []byte) (fattr3, error) {
+	res, err := c.call(&fhArgs{Header: c.header(nfsProc3Getattr), FH: fh})
+	if err != nil {
+		return fattr3{}, err
+	}
+	a := readFattr3(res)
+	return a, res.err
+}
+
+type setattrArgs struct {
+	rpc.Header
+	FH    []byte
+	Attr  sattr3
+	Guard uint32
+}
+
+// setMode sets the mode of a file and its mtime to the server's time.
+func (c *nfsClient) setMode(fh []byte, mode uint32) error {
+	attr := sattrMode(mode)
+	attr.SetMtime = setToServerTime
+	_, err := c.call(&setattrArgs{Header: c.header(nfsProc3Setattr), FH: fh, Attr: attr})
+	return err
+}
+
+// lookup returns the handle of a single name within a directory.
+func (c *nfsClient) lookup(dirFH []byte, name string) ([]byte, error) {
+	res, err := c.call(&diropArgs{Header: c.header(nfsProc3Lookup), Dir: dirFH, Name: name})
+	if err != nil {
+		return nil, err
+	}
+	fh := append([]byte(nil), res.opaque()...)
+	return fh, res.err
+}
+
+// mkdirPath returns the handle of a slash-separated path within a
+// directory, looking up one component at a time and creating any that do
+// not exist.
+func (c *nfsClient) mkdirPath(dirFH []byte, p string, mode uint32) ([]byte, error) {
+	fh := dirFH
+	for _, name := range strings.Split(p, "/") {
+		if name == "" || name == "." {
+			continue
+		}
+		parent := fh
+		var err error
+		fh, err = c.lookup(parent, name)
+		if err == nfs3ErrNoent {
+			fh, err = c.mkdir(parent, name, mode)
+			if err == nfs3ErrExist {
+				// Created by another client since the lookup.
+				fh, err = c.lookup(parent, name)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return fh, nil
+}
+
+// createdHandle reads the post_op_fh3 at the start of a CREATE or MKDIR
+// reply, looking the name up if the server did not return it.
+func (c *nfsClient) createdHandle(res *xdrReader, dirFH []byte, name string) ([]byte, error) {
+	if res.bool() {
+		fh := append([]byte(nil), res.opaque()...)
+		return fh, res.err
+	}
+	if res.err != nil {
+		return nil, res.err
+	}
+	return c.lookup(dirFH, name)
+}
+
+// createArgs encodes CREATE3args for an UNCHECKED create, and mkdirArgs
+// MKDIR3args.
+type createArgs struct {
+	rpc.Header
+	Dir  []byte
+	Name string
+	How  uint32
+	Attr sattr3
+}
+
+type mkdirArgs struct {
+	rpc.Header
+	Dir  []byte
+	Name string
+	Attr sattr3
+}
+
+// create creates a file within a directory, or opens it if it already
+// exists, and returns its handle.
+func (c *nfsClient) create(dirFH []byte, name string, mode uint32) ([]byte, error) {
+	res, err := c.call(&createArgs{Header: c.header(nfsProc3Create), Dir: dirFH, Name: name, Attr: sattrMode(mode)})
+	if err != nil {
+		return nil, err
+	}
+	return c.createdHandle(res, dirFH, name)
+}
+
+// mkdir creates a directory within a directory and returns its handle.
+func (c *nfsClient) mkdir(dirFH []byte, name string, mode uint32) ([]byte, error) {
+	res, err := c.call(&mkdirArgs{Header: c.header(nfsProc3Mkdir), Dir: dirFH, Name: name, Attr: sattrMode(mode)})
+	if err != nil {
+		return nil, err
+	}
+	return c.createdHandle(res, dirFH, name)
+}
+
+func (c *nfsClient) remove(dirFH []byte, name string) error {
+	_, err := c.call(&diropArgs{Header: c.header(nfsProc3Remove), Dir: dirFH, Name: name})
+	return err
+}
+
+func (c *nfsClient) rmdir(dirFH []byte, name string) error {
+	_, err := c.call(&diropArgs{Header: c.header(nfsProc3Rmdir), Dir: dirFH, Name: name})
+	return err
+}
+
+type renameArgs struct {
+	rpc.Header
+	FromDir  []byte
+	FromName string
+	ToDir    []byte
+	ToName   string
+}
+
+// rename renames a file within a single directory.
+func (c *nfsClient) rename(dirFH []byte, from string, to string) error {
+	_, err := c.call(&renameArgs{
+		Header:   c.header(nfsProc3Rename),
+		FromDir:  dirFH,
+		FromName: from,
+		ToDir:    dirFH,
+		ToName:   to,
+	})
+	return err
+}
+
+type readdirplusArgs struct {
+	rpc.Header
+	Dir        []byte
+	Cookie     uint64
+	CookieVerf uint64
+	DirCount   uint32
+	MaxCount   uint32
+}
+
+// Sizes requested of READDIRPLUS: the directory information and the whole
+// reply.
+const readdirDirCount = 8192
+const readdirMaxCount = 65536
+
+// readdirplusFirst issues a single READDIRPLUS for the start of a directory
+// and returns the number of entries in the reply.
+func (c *nfsClient) readdirplusFirst(dirFH []byte) (int, error) {
+	res, err := c.call(&readdirplusArgs{
+		Header:   c.header(nfsProc3Readdirplus),
+		Dir:      dirFH,
+		DirCount: readdirDirCount,
+		MaxCount: readdirMaxCount,
+	})
+	if err != nil {
+		return 0, err
+	}
+	// dir_attributes and cookieverf, then the entries as an XDR list.
+	skipOptional(res, fattr3Size)
+	res.skip(8)
+	entries := 0
+	for res.bool() {
+		// fileid, then name, cookie, name_attributes and name_handle.
+		res.skip(8)
+		res.opaque()
+		res.skip(8)
+		skipOptional(res, fattr3Size)
+		if res.bool() {
+			res.opaque()
+		}
+		entries++
+	}
+	return entries, res.err
+}
+
+// maxIO returns the server's maximum READ and WRITE sizes (rtmax and wtmax)
+// for the filesystem containing fh.
+func (c *nfsClient) maxIO(fh []byte) (uint32, uint32, error) {
+	res, err := c.call(&fhArgs{Header: c.header(nfsProc3Fsinfo), FH: fh})
+	if err != nil {
+		return 0, 0, err
+	}
+	skipOptional(res, fattr3Size)
+	rtmax := res.uint32()
+	res.skip(8) // rtpref, rtmult
+	wtmax := res.uint32()
+	if res.err != nil {
+		return 0, 0, res.err
+	}
+	if rtmax == 0 || wtmax == 0 {
+		return 0, 0, errors.New("FSINFO returned no maximum read or write size")
+	}
+	return rtmax, wtmax, nil
+}
+
+type readArgs struct {
+	rpc.Header
+	FH     []byte
+	Offset uint64
+	Count  uint32
+}
+
+// read issues a single READ of up to len(p) bytes at offset into p, and
+// returns the number of bytes read and whether they reach the end of file.
+func (c *nfsClient) read(fh []byte, offset uint64, p []byte) (int, bool, error) {
+	res, err := c.call(&readArgs{Header: c.header(nfsProc3Read), FH: fh, Offset: offset, Count: uint32(len(p))})
+	if err != nil {
+		return 0, false, err
+	}
+	skipOptional(res, fattr3Size)
+	res.uint32() // count, repeated as the length of data
+	eof := res.bool()
+	data := res.opaque()
+	if res.err != nil {
+		return 0, false, res.err
+	}
+	if len(data) > len(p) {
+		return 0, false, errors.New("READ returned more data than requested")
+	}
+	return copy(p, data), eof, nil
+}
+
+type writeArgs struct {
+	rpc.Header
+	FH       []byte
+	Offset   uint64
+	Count    uint32
+	Stable   uint32
+	Contents []byte
+}
+
+// write issues a single WRITE with the given stable_how and returns the
+// number of bytes the server wrote and its write verifier.
+func (c *nfsClient) write(fh []byte, offset uint64, p []byte, stable uint32) (int, uint64, error) {
+	res, err := c.call(&writeArgs{
+		Header:   c.header(nfsProc3Write),
+		FH:       fh,
+		Offset:   offset,
+		Count:    uint32(len(p)),
+		Stable:   stable,
+		Contents: p,
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	skipWccData(res)
+	count := res.uint32()
+	committed := res.uint32()
+	verf := res.uint64()
+	if res.err != nil {
+		return 0, 0, res.err
+	}
+	if committed < stable {
+		return int(count), verf, fmt.Errorf("WRITE committed data as %s, requested %s", stableHowName(committed), stableHowName(stable))
+	}
+	return int(count), verf, nil
+}
+
+type commitArgs struct {
+	rpc.Header
+	FH     []byte
+	Offset uint64
+	Count  uint32
+}
+
+// commit commits all unstable data written to the file, and returns the
+// server's write verifier.
+func (c *nfsClient) commit(fh []byte) (uint64, error) {
+	// An offset and count of zero commit to the end of file.
+	res, err := c.call(&commitArgs{Header: c.header(nfsProc3Commit), FH: fh})
+	if err != nil {
+		return 0, err
+	}
+	skipWccData(res)
+	verf := res.uint64()
+	return verf, res.err
+}
+
+func stableHowName(stable uint32) string {
+	switch stable {
+	case nfs3Unstable:
+		return "UNSTABLE"
+	case nfs3DataSync:
+		return "DATA_SYNC"
+	case nfs3FileSync:
+		return "FILE_SYNC"
+	}
+	return fmt.Sprint(stable)
+}
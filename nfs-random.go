@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+func generateRandomIOFilename(prefix string, i int) string {
+	return "random-" + prefix + "-" + strconv.Itoa(i)
+}
+
+// preallocateFile writes size bytes to fname so that random reads and
+// overwrites hit allocated blocks, and returns the file's handle.
+func (n *NFSTester) preallocateFile(c *nfsConn, fname string, size uint64) ([]byte, error) {
+	fh, err := c.client.create(n.dirFH, fname, 0744)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 1024*1024)
+	rand.Read(buf)
+	for written := uint64(0); written < size; {
+		chunk := buf
+		if size-written < uint64(len(chunk)) {
+			chunk = chunk[:size-written]
+		}
+		count, err := n.writeDirect(c.client, fh, written, chunk, nil)
+		if err != nil {
+			return nil, err
+		}
+		written += uint64(count)
+	}
+	return fh, nil
+}
+
+type randomIOCounters struct {
+	mu           sync.Mutex
+	readLatency  *latencyHistogram
+	writeLatency *latencyHistogram
+	reads        uint64
+	writes       uint64
+	failedReads  uint64
+	failedWrites uint64
+}
+
+// randomIOWorker issues each operation as a single READ or WRITE call at an
+// explicit offset of the file with handle fh.
+func (n *NFSTester) randomIOWorker(conn *nfsConn, fh []byte, fileSize uint64, blockSize int, readPercent int, c *randomIOCounters) {
+
+	defer n.wg.Done()
+
+	stable := n.stableHow()
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	buf := make([]byte, blockSize)
+	rng.Read(buf)
+	blocks := int64(fileSize / uint64(blockSize))
+
+	readLatency, writeLatency := newLatencyHistogram(), newLatencyHistogram()
+	reads, writes, failedReads, failedWrites := uint64(0), uint64(0), uint64(0), uint64(0)
+
+	for atomic.LoadInt32(&n.atm_finished) == 0 {
+		offset := uint64(rng.Int63n(blocks)) * uint64(blockSize)
+		isRead := rng.Intn(100) < readPercent
+
+		// A short READ or WRITE counts as a failure, as the operation did
+		// not transfer the whole block.
+		start := time.Now()
+		var count int
+		var err error
+		if isRead {
+			count, _, err = conn.client.read(fh, offset, buf)
+		} else {
+			count, _, err = conn.client.write(fh, offset, buf, stable)
+		}
+		if err == nil && count != blockSize {
+			err = io.ErrShortWrite
+			if isRead {
+				err = io.ErrUnexpectedEOF
+			}
+		}
+
+		switch {
+		case isRead && err != nil:
+			failedReads++
+		case isRead:
+			readLatency.RecordSince(start)
+			reads++
+		case err != nil:
+			failedWrites++
+		default:
+			writeLatency.RecordSince(start)
+			writes++
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readLatency.Merge(readLatency)
+	c.writeLatency.Merge(writeLatency)
+	c.reads += reads
+	c.writes += writes
+	c.failedReads += failedReads
+	c.failedWrites += failedWrites
+}
+
+// RandomIOTest measures IOPS and latency of random, block-aligned reads and
+// writes. The working set is split into one pre-allocated file per worker, and
+// each operation is a single READ or WRITE call of blockSize bytes at a random
+// block's offset, with readPercent of operations being reads. The block size
+// must not exceed the server's maximum READ and WRITE sizes. The files are
+// removed afterwards.
+func (n *NFSTester) RandomIOTest(blockSize int, readPercent int, workingSetBytes uint64) []OperationResult {
+
+	fileSize := workingSetBytes / uint64(n.concurrency)
+	fileSize -= fileSize % uint64(blockSize)
+	if fileSize == 0 {
+		fmt.Println("[error] Random IO working set is smaller than one block per worker.")
+		return nil
+	}
+	if uint32(blockSize) > n.rtmax || uint32(blockSize) > n.wtmax {
+		fmt.Printf("[error] Random IO block size exceeds the server's maximum READ size of %d or WRITE size of %d bytes.\n", n.rtmax, n.wtmax)
+		return nil
+	}
+
+	// Keep each file's handle, so that operations go straight to READ and
+	// WRITE calls.
+	fmt.Printf("Pre-allocating %d files of %d bytes for random IO test.\n", n.concurrency, fileSize)
+	var failed int32
+	fhs := make([][]byte, n.concurrency+1)
+	for i := 1; i <= n.concurrency; i++ {
+		n.wg.Add(1)
+		go func(i int, c *nfsConn, fname string) {
+			defer n.wg.Done()
+			fh, err := n.preallocateFile(c, fname, fileSize)
+			if err != nil {
+				fmt.Printf("Pre-allocating %s failed: %v\n", fname, err)
+				atomic.StoreInt32(&failed, 1)
+			}
+			fhs[i] = fh
+		}(i, n.conn(i), generateRandomIOFilename(n.uniqueId, i))
+	}
+	n.wg.Wait()
+
+	var results []OperationResult
+	if atomic.LoadInt32(&failed) == 0 {
+		c := &randomIOCounters{readLatency: newLatencyHistogram(), writeLatency: newLatencyHistogram()}
+
+		atomic.StoreInt32(&n.atm_finished, 0)
+		for i := 1; i <= n.concurrency; i++ {
+			n.wg.Add(1)
+			go n.randomIOWorker(n.conn(i), fhs[i], fileSize, blockSize, readPercent, c)
+		}
+		start := time.Now()
+		time.Sleep(time.Duration(n.durationSeconds) * time.Second)
+		atomic.StoreInt32(&n.atm_finished, 1)
+		n.wg.Wait()
+		elapsed := time.Since(start)
+
+		label := fmt.Sprintf("bs=%dKiB", blockSize/1024)
+		if readPercent > 0 {
+			results = append(results, newOperationResult("RANDOM READ "+label, c.reads, c.failedReads, c.readLatency, elapsed))
+		}
+		if readPercent < 100 {
+			results = append(results, newOperationResult("RANDOM WRITE "+label, c.writes, c.failedWrites, c.writeLatency, elapsed))
+		}
+	}
+
+	c := n.conns[0]
+	for i := 1; i <= n.concurrency; i++ {
+		c.client.remove(n.dirFH, generateRandomIOFilename(n.uniqueId, i))
+	}
+	return results
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/joshuarobinson/go-nfs-client/nfs/rpc"
+)
+
+// go-nfs-client's Mount and Target dial their own connections, which cannot
+// be bound to a source address. The NFS tests instead dial the portmapper,
+// MOUNT and NFS services with rpc.DialTCP, which takes the local address to
+// dial from, and issue their procedures on the resulting rpc.Client, building
+// the XDR arguments the same way the library does.
+
+// xdrReader decodes XDR values. The first error is kept and later reads
+// return zero values, so a reply can be decoded in full before checking err.
+type xdrReader struct {
+	b   []byte
+	err error
+}
+
+var errShortXDR = errors.New("XDR data is too short")
+
+func (r *xdrReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.b) {
+		r.err = errShortXDR
+		return nil
+	}
+	p := r.b[:n]
+	r.b = r.b[n:]
+	return p
+}
+
+func (r *xdrReader) uint32() uint32 {
+	p := r.next(4)
+	if p == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(p)
+}
+
+func (r *xdrReader) uint64() uint64 {
+	p := r.next(8)
+	if p == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(p)
+}
+
+func (r *xdrReader) bool() bool {
+	return r.uint32() != 0
+}
+
+// opaque returns a variable-length opaque, aliasing the reader's buffer.
+func (r *xdrReader) opaque() []byte {
+	n := int(r.uint32())
+	p := r.next(n)
+	r.next((4 - n%4) % 4)
+	return p
+}
+
+func (r *xdrReader) string() string {
+	return string(r.opaque())
+}
+
+func (r *xdrReader) skip(n int) {
+	r.next(n)
+}
+
+// AUTH_UNIX credentials carry at most 16 supplementary groups.
+const maxAuthUnixGids = 16
+
+// authUnix encodes AUTH_UNIX credentials (RFC 5531). rpc.NewAuthUnix has no
+// way to set supplementary groups, so the body is built here instead.
+func authUnix(machineName string, uid uint32, gid uint32, gids []uint32) rpc.Auth {
+	w := new(bytes.Buffer)
+	binary.Write(w, binary.BigEndian, uint32(time.Now().Unix()))
+	binary.Write(w, binary.BigEndian, uint32(len(machineName)))
+	w.WriteString(machineName)
+	w.Write(make([]byte, (4-len(machineName)%4)%4))
+	binary.Write(w, binary.BigEndian, uid)
+	binary.Write(w, binary.BigEndian, gid)
+	binary.Write(w, binary.BigEndian, uint32(len(gids)))
+	for _, g := range gids {
+		binary.Write(w, binary.BigEndian, g)
+	}
+	return rpc.Auth{Flavor: 1, Body: w.Bytes()}
+}
+
+// Programs used by the NFS tests.
+const portmapProg = 100000
+const portmapVers = 2
+const portmapProcGetport = 3
+const mountProg = 100005
+const mountVers = 3
+const mountProcMnt = 1
+const nfs3Prog = 100003
+const nfs3Vers = 3
+
+const ipProtoTCP = 6
+
+func rpcHeader(prog uint32, vers uint32, proc uint32, cred rpc.Auth) rpc.Header {
+	return rpc.Header{
+		Rpcvers: 2,
+		Prog:    prog,
+		Vers:    vers,
+		Proc:    proc,
+		Cred:    cred,
+		Verf:    rpc.AuthNull,
+	}
+}
+
+// dialRPC connects to an RPC service at addr, from sourceIP if set.
+func dialRPC(sourceIP string, addr string) (*rpc.Client, error) {
+	var local *net.TCPAddr
+	if sourceIP != "" {
+		local = &net.TCPAddr{IP: net.ParseIP(sourceIP)}
+	}
+	return rpc.DialTCP("tcp", local, addr)
+}
+
+// rpcTimeout bounds every call, so that a stalled server fails the call
+// instead of hanging the test.
+var rpcTimeout = 30 * time.Second
+
+// rpcCall issues a call on c and returns the results of a successful reply.
+// If no reply arrives within rpcTimeout, c is closed, which fails the call in
+// progress, and the connection must not be used again.
+func rpcCall(c *rpc.Client, args interface{}) (*xdrReader, error) {
+	type reply struct {
+		body []byte
+		err  error
+	}
+	done := make(chan reply, 1)
+	go func() {
+		res, err := c.Call(args)
+		if err != nil {
+			done <- reply{err: err}
+			return
+		}
+		body, err := ioutil.ReadAll(res)
+		done <- reply{body: body, err: err}
+	}()
+
+	timer := time.NewTimer(rpcTimeout)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		if r.err != nil {
+			return nil, r.err
+		}
+		return &xdrReader{b: r.body}, nil
+	case <-timer.C:
+		c.Close()
+		return nil, fmt.Errorf("no reply to RPC call within %v", rpcTimeout)
+	}
+}
+
+// portmapperAddr returns the portmapper address of host, which may give a
+// port other than the standard 111.
+func portmapperAddr(host string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(host, "111")
+}
+
+type getportArgs struct {
+	rpc.Header
+	Prog uint32
+	Vers uint32
+	Prot uint32
+	Port uint32
+}
+
+// serviceAddr asks the portmapper of host for the TCP port of an RPC
+// program and returns the program's address.
+func serviceAddr(sourceIP string, host string, prog uint32, vers uint32) (string, error) {
+	pmap, err := dialRPC(sourceIP, portmapperAddr(host))
+	if err != nil {
+		return "", err
+	}
+	defer pmap.Close()
+
+	res, err := rpcCall(pmap, &getportArgs{
+		Header: rpcHeader(portmapProg, portmapVers, portmapProcGetport, rpc.AuthNull),
+		Prog:   prog,
+		Vers:   vers,
+		Prot:   ipProtoTCP,
+	})
+	if err != nil {
+		return "", err
+	}
+	port := res.uint32()
+	if res.err != nil {
+		return "", res.err
+	}
+	if port == 0 {
+		return "", fmt.Errorf("RPC program %d version %d is not registered", prog, vers)
+	}
+
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	return net.JoinHostPort(hostname, fmt.Sprint(port)), nil
+}
+
+// mountError is a MOUNT status other than MNT3_OK.
+type mountError uint32
+
+func (e mountError) Error() string {
+	switch e {
+	case 1:
+		return "MOUNT failed: not owner"
+	case 2:
+		return "MOUNT failed: no such export"
+	case 13:
+		return "MOUNT failed: permission denied"
+	case 20:
+		return "MOUNT failed: not a directory"
+	}
+	return fmt.Sprintf("MOUNT failed with status %d", uint32(e))
+}
+
+type mountArgs struct {
+	rpc.Header
+	Dirpath string
+}
+
+// mountExport asks the MOUNT service of host for the root file handle of
+// export. MOUNT keeps no state that NFSv3 depends on, so the connection is
+// closed straight away and the export is never unmounted.
+func mountExport(sourceIP string, host string, export string, auth rpc.Auth) ([]byte, error) {
+	addr, err := serviceAddr(sourceIP, host, mountProg, mountVers)
+	if err != nil {
+		return nil, err
+	}
+	mnt, err := dialRPC(sourceIP, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer mnt.Close()
+
+	res, err := rpcCall(mnt, &mountArgs{Header: rpcHeader(mountProg, mountVers, mountProcMnt, auth), Dirpath: export})
+	if err != nil {
+		return nil, err
+	}
+	if stat := res.uint32(); stat != 0 {
+		return nil, mountError(stat)
+	}
+	fh := append([]byte(nil), res.opaque()...)
+	return fh, res.err
+}
@@ -0,0 +1,719 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testNFSServer is a memory-backed NFSv3, MOUNT and portmapper server for
+// tests, listening on loopback ports. File handles are the 8-byte file ids
+// of its nodes. Directories are checked for write permission against the
+// caller's AUTH_UNIX credentials, so tests can exercise permission errors.
+type testNFSServer struct {
+	pmap  net.Listener
+	mount net.Listener
+	nfs   net.Listener
+
+	rtmax uint32
+	wtmax uint32
+
+	// inFlight and maxInFlight count the NFS calls being handled at once.
+	inFlight    int32
+	maxInFlight int32
+
+	mu      sync.Mutex
+	nodes   map[uint64]*testNode
+	nextId  uint64
+	exports map[string]uint64
+	conns   int
+	creds   []testCred
+	// calls counts the NFS calls handled, by procedure.
+	calls map[uint32]int
+
+	// latency delays the handling of each NFS call.
+	latency time.Duration
+
+	// committed overrides the stable_how returned by WRITE if set, and
+	// verf is the write verifier returned by WRITE and COMMIT.
+	committed *uint32
+	verf      uint64
+
+	wg sync.WaitGroup
+}
+
+type testNode struct {
+	id       uint64
+	dir      bool
+	mode     uint32
+	uid      uint32
+	gid      uint32
+	data     []byte
+	children map[string]uint64
+}
+
+// testCred is the AUTH_UNIX credentials of a call.
+type testCred struct {
+	machineName string
+	uid         uint32
+	gid         uint32
+	gids        []uint32
+}
+
+// startTestNFSServer starts a server with one export, whose root directory
+// is owned by uid and gid 1001 with mode 0755, and stops it when the test
+// ends.
+func startTestNFSServer(t *testing.T, export string) *testNFSServer {
+	t.Helper()
+	s := &testNFSServer{
+		rtmax:   256 * 1024,
+		wtmax:   256 * 1024,
+		nodes:   make(map[uint64]*testNode),
+		exports: make(map[string]uint64),
+		verf:    1,
+	}
+	root := s.newNode(true, 0755, testCred{uid: 1001, gid: 1001})
+	s.exports[export] = root.id
+
+	for _, l := range []*net.Listener{&s.pmap, &s.mount, &s.nfs} {
+		var err error
+		*l, err = net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.serve(s.pmap, s.portmap)
+	s.serve(s.mount, s.mountProc)
+	s.serve(s.nfs, s.nfsProc)
+	t.Cleanup(s.close)
+	return s
+}
+
+// addr is the host to give NFSTester, naming the portmapper's port.
+func (s *testNFSServer) addr() string {
+	return s.pmap.Addr().String()
+}
+
+// set changes the server's settings under its lock.
+func (s *testNFSServer) set(f func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f()
+}
+
+// connCount returns the number of NFS connections accepted.
+func (s *testNFSServer) connCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conns
+}
+
+// callCount returns the number of calls handled of procedure proc.
+func (s *testNFSServer) callCount(proc uint32) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[proc]
+}
+
+func (s *testNFSServer) close() {
+	s.pmap.Close()
+	s.mount.Close()
+	s.nfs.Close()
+	s.wg.Wait()
+}
+
+// newNode adds a node owned by cred. The caller holds mu, if needed.
+func (s *testNFSServer) newNode(dir bool, mode uint32, cred testCred) *testNode {
+	s.nextId++
+	n := &testNode{id: s.nextId, dir: dir, mode: mode, uid: cred.uid, gid: cred.gid}
+	if dir {
+		n.children = make(map[string]uint64)
+	}
+	s.nodes[n.id] = n
+	return n
+}
+
+// entries returns the names in the directory with the given handle.
+func (s *testNFSServer) entries(t *testing.T, fh []byte) []string {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := s.node(fh)
+	if n == nil || !n.dir {
+		t.Fatalf("no directory with handle %x", fh)
+	}
+	var names []string
+	for name := range n.children {
+		names = append(names, name)
+	}
+	return names
+}
+
+// rootEntries returns the names in the root of an export.
+func (s *testNFSServer) rootEntries(t *testing.T, export string) []string {
+	var fh [8]byte
+	s.mu.Lock()
+	binary.BigEndian.PutUint64(fh[:], s.exports[export])
+	s.mu.Unlock()
+	return s.entries(t, fh[:])
+}
+
+func (s *testNFSServer) node(fh []byte) *testNode {
+	if len(fh) != 8 {
+		return nil
+	}
+	return s.nodes[binary.BigEndian.Uint64(fh)]
+}
+
+func nodeHandle(n *testNode) []byte {
+	var fh [8]byte
+	binary.BigEndian.PutUint64(fh[:], n.id)
+	return fh[:]
+}
+
+// xdrWriter encodes XDR (RFC 4506) values.
+type xdrWriter struct {
+	bytes.Buffer
+}
+
+func (w *xdrWriter) uint32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	w.Write(b[:])
+}
+
+func (w *xdrWriter) uint64(v uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	w.Write(b[:])
+}
+
+func (w *xdrWriter) bool(v bool) {
+	if v {
+		w.uint32(1)
+	} else {
+		w.uint32(0)
+	}
+}
+
+// opaque writes a variable-length opaque, padded to a multiple of 4 bytes.
+func (w *xdrWriter) opaque(p []byte) {
+	w.uint32(uint32(len(p)))
+	w.Write(p)
+	w.Write(make([]byte, (4-len(p)%4)%4))
+}
+
+func (w *xdrWriter) string(s string) {
+	w.opaque([]byte(s))
+}
+
+// Auth flavors, message types and reply states of RPC messages.
+const authNoneFlavor = 0
+const authUnixFlavor = 1
+const rpcReply = 1
+const rpcMsgAccepted = 0
+
+// A record fragment header has the last-fragment flag in its top bit.
+const lastFragment = 1 << 31
+
+// readRecord reads one RPC record, joining its fragments.
+func readRecord(r io.Reader) ([]byte, error) {
+	var record []byte
+	for {
+		var header [4]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return nil, err
+		}
+		marker := binary.BigEndian.Uint32(header[:])
+		size := int(marker &^ lastFragment)
+		if len(record)+size > 64*1024*1024 {
+			return nil, fmt.Errorf("RPC record of %d bytes", len(record)+size)
+		}
+		fragment := make([]byte, size)
+		if _, err := io.ReadFull(r, fragment); err != nil {
+			return nil, err
+		}
+		record = append(record, fragment...)
+		if marker&lastFragment != 0 {
+			return record, nil
+		}
+	}
+}
+
+// serve accepts connections on l and answers their calls with handler,
+// each call in its own goroutine as a server may.
+func (s *testNFSServer) serve(l net.Listener, handler func(proc uint32, cred testCred, args *xdrReader, res *xdrWriter) uint32) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if l == s.nfs {
+				s.mu.Lock()
+				s.conns++
+				s.mu.Unlock()
+			}
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				s.serveConn(conn, handler)
+			}()
+		}
+	}()
+}
+
+func (s *testNFSServer) serveConn(conn net.Conn, handler func(proc uint32, cred testCred, args *xdrReader, res *xdrWriter) uint32) {
+	defer conn.Close()
+	var sendMu sync.Mutex
+	var calls sync.WaitGroup
+	defer calls.Wait()
+	for {
+		record, err := readRecord(conn)
+		if err != nil {
+			return
+		}
+		calls.Add(1)
+		go func() {
+			defer calls.Done()
+			r := &xdrReader{b: record}
+			xid := r.uint32()
+			r.uint32() // CALL
+			r.uint32() // rpcvers
+			r.uint32() // prog
+			r.uint32() // vers
+			proc := r.uint32()
+			var cred testCred
+			if r.uint32() == authUnixFlavor {
+				body := &xdrReader{b: r.opaque()}
+				body.uint32() // stamp
+				cred.machineName = body.string()
+				cred.uid = body.uint32()
+				cred.gid = body.uint32()
+				for i := body.uint32(); i > 0 && body.err == nil; i-- {
+					cred.gids = append(cred.gids, body.uint32())
+				}
+			} else {
+				r.opaque()
+			}
+			r.uint32() // verifier
+			r.opaque()
+
+			res := new(xdrWriter)
+			stat := handler(proc, cred, r, res)
+
+			w := new(xdrWriter)
+			w.uint32(0)
+			w.uint32(xid)
+			w.uint32(rpcReply)
+			w.uint32(rpcMsgAccepted)
+			w.uint32(authNoneFlavor)
+			w.opaque(nil)
+			w.uint32(stat)
+			w.Write(res.Bytes())
+			reply := w.Bytes()
+			binary.BigEndian.PutUint32(reply, lastFragment|uint32(len(reply)-4))
+			sendMu.Lock()
+			conn.Write(reply)
+			sendMu.Unlock()
+		}()
+	}
+}
+
+// portmap answers GETPORT for the MOUNT and NFS programs.
+func (s *testNFSServer) portmap(proc uint32, cred testCred, args *xdrReader, res *xdrWriter) uint32 {
+	if proc != portmapProcGetport {
+		return 3
+	}
+	var l net.Listener
+	switch args.uint32() {
+	case mountProg:
+		l = s.mount
+	case nfs3Prog:
+		l = s.nfs
+	}
+	port := uint32(0)
+	if l != nil {
+		port = uint32(l.Addr().(*net.TCPAddr).Port)
+	}
+	res.uint32(port)
+	return 0
+}
+
+func (s *testNFSServer) mountProc(proc uint32, cred testCred, args *xdrReader, res *xdrWriter) uint32 {
+	if proc != mountProcMnt {
+		return 3
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id, ok := s.exports[args.string()]
+	if !ok {
+		res.uint32(2) // MNT3ERR_NOENT
+		return 0
+	}
+	res.uint32(0)
+	res.opaque(nodeHandle(s.nodes[id]))
+	res.uint32(1)
+	res.uint32(authUnixFlavor)
+	return 0
+}
+
+func writeTestFattr(w *xdrWriter, n *testNode) {
+	ftype, mode := uint32(1), n.mode
+	if n.dir {
+		ftype = 2
+	}
+	w.uint32(ftype)
+	w.uint32(mode)
+	w.uint32(1)
+	w.uint32(n.uid)
+	w.uint32(n.gid)
+	w.uint64(uint64(len(n.data)))
+	w.uint64(uint64(len(n.data)))
+	w.uint64(0) // rdev
+	w.uint64(1) // fsid
+	w.uint64(n.id)
+	w.uint64(0) // atime
+	w.uint64(0) // mtime
+	w.uint64(0) // ctime
+}
+
+// readTestSattr reads an sattr3, returning the mode if set.
+func readTestSattr(r *xdrReader) (uint32, bool) {
+	mode, setMode := uint32(0), r.bool()
+	if setMode {
+		mode = r.uint32()
+	}
+	if r.bool() {
+		r.uint32()
+	}
+	if r.bool() {
+		r.uint32()
+	}
+	if r.bool() {
+		r.uint64()
+	}
+	for i := 0; i < 2; i++ {
+		if r.uint32() == 2 {
+			r.uint64()
+		}
+	}
+	return mode, setMode
+}
+
+// writable reports whether cred may change the entries of dir.
+func writable(dir *testNode, cred testCred) bool {
+	switch {
+	case cred.uid == 0:
+		return true
+	case cred.uid == dir.uid:
+		return dir.mode&0200 != 0
+	case cred.gid == dir.gid:
+		return dir.mode&0020 != 0
+	}
+	return dir.mode&0002 != 0
+}
+
+// procUnavail is returned by nfsCall for procedures the server lacks.
+const procUnavail = ^uint32(0)
+
+// nfsProc handles an NFSv3 call. Replies to failed calls carry only the
+// status, which is all NFSTester reads of them.
+func (s *testNFSServer) nfsProc(proc uint32, cred testCred, args *xdrReader, res *xdrWriter) uint32 {
+	inFlight := atomic.AddInt32(&s.inFlight, 1)
+	defer atomic.AddInt32(&s.inFlight, -1)
+	for max := atomic.LoadInt32(&s.maxInFlight); inFlight > max; max = atomic.LoadInt32(&s.maxInFlight) {
+		if atomic.CompareAndSwapInt32(&s.maxInFlight, max, inFlight) {
+			break
+		}
+	}
+	s.mu.Lock()
+	latency := s.latency
+	s.mu.Unlock()
+	time.Sleep(latency)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.creds = append(s.creds, cred)
+	if s.calls == nil {
+		s.calls = make(map[uint32]int)
+	}
+	s.calls[proc]++
+
+	stat := s.nfsCall(proc, cred, args, res)
+	if stat == procUnavail {
+		return 3
+	}
+	if stat != 0 || args.err != nil {
+		if args.err != nil {
+			stat = uint32(nfs3ErrInval)
+		}
+		res.Reset()
+		res.uint32(stat)
+	}
+	return 0
+}
+
+// dirop reads a diropargs3 and checks that it names an entry of a
+// directory.
+func (s *testNFSServer) dirop(args *xdrReader) (*testNode, string, uint32) {
+	dir := s.node(args.opaque())
+	name := args.string()
+	if dir == nil {
+		return nil, "", uint32(nfs3ErrStale)
+	}
+	if !dir.dir {
+		return nil, "", uint32(nfs3ErrNotdir)
+	}
+	return dir, name, 0
+}
+
+func (s *testNFSServer) nfsCall(proc uint32, cred testCred, args *xdrReader, res *xdrWriter) uint32 {
+	noWcc := func() {
+		res.bool(false)
+		res.bool(false)
+	}
+
+	switch proc {
+	case nfsProc3Getattr, nfsProc3Setattr, nfsProc3Read, nfsProc3Write, nfsProc3Fsinfo, nfsProc3Commit:
+		n := s.node(args.opaque())
+		if n == nil {
+			return uint32(nfs3ErrStale)
+		}
+		switch proc {
+		case nfsProc3Getattr:
+			res.uint32(0)
+			writeTestFattr(res, n)
+		case nfsProc3Setattr:
+			if mode, ok := readTestSattr(args); ok {
+				if cred.uid != 0 && cred.uid != n.uid {
+					return uint32(nfs3ErrPerm)
+				}
+				n.mode = mode
+			}
+			res.uint32(0)
+			noWcc()
+		case nfsProc3Read:
+			offset, count := args.uint64(), args.uint32()
+			if n.dir {
+				return uint32(nfs3ErrIsdir)
+			}
+			if count > s.rtmax {
+				count = s.rtmax
+			}
+			var data []byte
+			if offset < uint64(len(n.data)) {
+				data = n.data[offset:]
+			}
+			if len(data) > int(count) {
+				data = data[:count]
+			}
+			res.uint32(0)
+			res.bool(false)
+			res.uint32(uint32(len(data)))
+			res.bool(offset+uint64(len(data)) >= uint64(len(n.data)))
+			res.opaque(data)
+		case nfsProc3Write:
+			offset := args.uint64()
+			args.uint32() // count
+			stable := args.uint32()
+			data := args.opaque()
+			if n.dir {
+				return uint32(nfs3ErrIsdir)
+			}
+			if len(data) > int(s.wtmax) {
+				data = data[:s.wtmax]
+			}
+			if end := offset + uint64(len(data)); end > uint64(len(n.data)) {
+				n.data = append(n.data, make([]byte, end-uint64(len(n.data)))...)
+			}
+			copy(n.data[offset:], data)
+			if s.committed != nil {
+				stable = *s.committed
+			}
+			res.uint32(0)
+			noWcc()
+			res.uint32(uint32(len(data)))
+			res.uint32(stable)
+			res.uint64(s.verf)
+		case nfsProc3Fsinfo:
+			res.uint32(0)
+			res.bool(false)
+			res.uint32(s.rtmax)
+			res.uint32(s.rtmax)
+			res.uint32(4096)
+			res.uint32(s.wtmax)
+			res.uint32(s.wtmax)
+			res.uint32(4096)
+			res.uint32(8192)
+			res.uint64(1 << 62)
+			res.uint32(0)
+			res.uint32(1)
+			res.uint32(0x1b)
+		case nfsProc3Commit:
+			res.uint32(0)
+			noWcc()
+			res.uint64(s.verf)
+		}
+		return 0
+
+	case nfsProc3Lookup:
+		dir, name, stat := s.dirop(args)
+		if stat != 0 {
+			return stat
+		}
+		id, ok := dir.children[name]
+		if !ok {
+			return uint32(nfs3ErrNoent)
+		}
+		res.uint32(0)
+		res.opaque(nodeHandle(s.nodes[id]))
+		res.bool(true)
+		writeTestFattr(res, s.nodes[id])
+		res.bool(false)
+		return 0
+
+	case nfsProc3Create, nfsProc3Mkdir:
+		dir, name, stat := s.dirop(args)
+		if stat != 0 {
+			return stat
+		}
+		if proc == nfsProc3Create && args.uint32() == 2 {
+			return uint32(nfs3ErrInval) // EXCLUSIVE is not supported
+		}
+		mode, _ := readTestSattr(args)
+		if !writable(dir, cred) {
+			return uint32(nfs3ErrAcces)
+		}
+		id, exists := dir.children[name]
+		if exists && (proc == nfsProc3Mkdir || s.nodes[id].dir) {
+			return uint32(nfs3ErrExist)
+		}
+		if !exists {
+			n := s.newNode(proc == nfsProc3Mkdir, mode, cred)
+			dir.children[name] = n.id
+			id = n.id
+		}
+		res.uint32(0)
+		res.bool(true)
+		res.opaque(nodeHandle(s.nodes[id]))
+		res.bool(false)
+		noWcc()
+		return 0
+
+	case nfsProc3Remove, nfsProc3Rmdir:
+		dir, name, stat := s.dirop(args)
+		if stat != 0 {
+			return stat
+		}
+		id, ok := dir.children[name]
+		if !ok {
+			return uint32(nfs3ErrNoent)
+		}
+		n := s.nodes[id]
+		switch {
+		case !writable(dir, cred):
+			return uint32(nfs3ErrAcces)
+		case proc == nfsProc3Remove && n.dir:
+			return uint32(nfs3ErrIsdir)
+		case proc == nfsProc3Rmdir && !n.dir:
+			return uint32(nfs3ErrNotdir)
+		case proc == nfsProc3Rmdir && len(n.children) > 0:
+			return uint32(nfs3ErrNotempty)
+		}
+		delete(dir.children, name)
+		delete(s.nodes, id)
+		res.uint32(0)
+		noWcc()
+		return 0
+
+	case nfsProc3Rename:
+		from, fromName, stat := s.dirop(args)
+		if stat != 0 {
+			return stat
+		}
+		to, toName, stat := s.dirop(args)
+		if stat != 0 {
+			return stat
+		}
+		id, ok := from.children[fromName]
+		if !ok {
+			return uint32(nfs3ErrNoent)
+		}
+		if !writable(from, cred) || !writable(to, cred) {
+			return uint32(nfs3ErrAcces)
+		}
+		delete(from.children, fromName)
+		to.children[toName] = id
+		res.uint32(0)
+		noWcc()
+		noWcc()
+		return 0
+
+	case nfsProc3Readdirplus:
+		dir := s.node(args.opaque())
+		if dir == nil {
+			return uint32(nfs3ErrStale)
+		}
+		if !dir.dir {
+			return uint32(nfs3ErrNotdir)
+		}
+		res.uint32(0)
+		res.bool(false)
+		res.uint64(0)
+		cookie := uint64(0)
+		for name, id := range dir.children {
+			cookie++
+			res.bool(true)
+			res.uint64(id)
+			res.string(name)
+			res.uint64(cookie)
+			res.bool(true)
+			writeTestFattr(res, s.nodes[id])
+			res.bool(true)
+			res.opaque(nodeHandle(s.nodes[id]))
+		}
+		res.bool(false)
+		res.bool(true)
+		return 0
+	}
+	return procUnavail
+}
+
+func TestNFSRPCPortmapperAddr(t *testing.T) {
+	tests := map[string]string{
+		"10.0.0.1":       "10.0.0.1:111",
+		"10.0.0.1:1111":  "10.0.0.1:1111",
+		"fd00::1":        "[fd00::1]:111",
+		"[fd00::1]:1111": "[fd00::1]:1111",
+		"nfs.example":    "nfs.example:111",
+	}
+	for host, want := range tests {
+		if got := portmapperAddr(host); got != want {
+			t.Errorf("portmapperAddr(%q) = %q, want %q", host, got, want)
+		}
+	}
+}
+
+func TestNFSRPCServiceAddr(t *testing.T) {
+	s := startTestNFSServer(t, "/fs")
+	addr, err := serviceAddr("127.0.0.1", s.addr(), nfs3Prog, nfs3Vers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "127.0.0.1:" + strconv.Itoa(s.nfs.Addr().(*net.TCPAddr).Port); addr != want {
+		t.Errorf("serviceAddr = %q, want %q", addr, want)
+	}
+	if _, err := serviceAddr("", s.addr(), 100099, 1); err == nil {
+		t.Error("serviceAddr of an unregistered program succeeded")
+	}
+}
@@ -4,32 +4,103 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"math/rand"
-	"os"
+	"path"
 	"strconv"
 	"sync"
-	"sync/atomic"
 	"time"
 
-	"github.com/joshuarobinson/go-nfs-client/nfs"
 	"github.com/joshuarobinson/go-nfs-client/nfs/rpc"
 )
 
-type NFSTester struct {
-	nfshost         string
-	export          string
-	concurrency     int
-	durationSeconds int
-	uniqueId        string
+// NFSCredentials are the AUTH_UNIX credentials sent with every NFS call.
+type NFSCredentials struct {
+	Uid         uint32
+	Gid         uint32
+	Gids        []uint32
+	MachineName string
+}
+
+// defaultNFSCredentials are sent when NFSOptions has no Credentials.
+var defaultNFSCredentials = NFSCredentials{Uid: 1001, Gid: 1001, MachineName: "anon"}
+
+// NFSOptions holds optional NFSTester settings.
+type NFSOptions struct {
+	// Credentials, if set, replaces defaultNFSCredentials.
+	Credentials *NFSCredentials
+
+	// Subdir, if set, is a directory within the export under which each run
+	// creates and uses its own subdirectory, instead of the export's root.
+	Subdir string
+
+	// Verify writes self-describing blocks derived from Seed and checks
+	// every block read back.
+	Verify bool
+	Seed   uint64
+
+	// FileSize bounds the size of each test file, in bytes, and must be a
+	// multiple of 1 MiB. Zero lets each writer append to one file for the
+	// whole test.
+	FileSize uint64
+	// FilesPerWorker is the number of files each writer cycles through
+	// when FileSize is set.
+	FilesPerWorker int
+
+	// Stability is the stable_how of WRITE calls, unstable by default.
+	Stability writeStability
+	// CommitBytes, with unstable writes, issues a COMMIT after every
+	// CommitBytes written and before closing each file.
+	CommitBytes uint64
+
+	// Connections is the number of mounted TCP connections shared by the
+	// workers. Zero gives each worker its own connection.
+	Connections int
+
+	// SourceIP, if set, is the local address that the portmapper, MOUNT
+	// and NFS connections are dialed from.
+	SourceIP string
+}
+
+type writeStability int
+
+const (
+	stabilityUnstable writeStability = iota
+	stabilityFileSync
+)
+
+func parseWriteStability(s string) (writeStability, error) {
+	switch s {
+	case "", "unstable":
+		return stabilityUnstable, nil
+	case "file-sync":
+		return stabilityFileSync, nil
+	}
+	return stabilityUnstable, fmt.Errorf("[error] Unknown write stability %s, expected unstable or file-sync.", s)
+}
 
-	wg                        sync.WaitGroup
-	atm_finished              int32
-	atm_counter_bytes_written uint64
-	atm_counter_bytes_read    uint64
-	filesWritten              int
+// NFSTester runs the NFS tests on the RPC connections it opens. The sequential
+// write and read tests are those of seqTester, on files created in dirFH.
+type NFSTester struct {
+	seqTester
+
+	nfshost string
+	export  string
+	opts    NFSOptions
+	cred    rpc.Auth
+	conns   []*nfsConn
+
+	// Handles of the export's root and of the directory holding the test
+	// files, which is runDir within parentFH when a Subdir is used.
+	rootFH   []byte
+	dirFH    []byte
+	parentFH []byte
+	runDir   string
+
+	// Maximum READ and WRITE sizes of the server.
+	rtmax uint32
+	wtmax uint32
 }
 
-func NewNFSTester(nfshost string, export string, uniqueId string, concurrency int, duration int) (*NFSTester, error) {
+func NewNFSTester(nfshost string, export string, uniqueId string, concurrency int, duration int, opts NFSOptions) (*NFSTester, error) {
 
 	if len(nfshost) == 0 || len(export) == 0 {
 		err := errors.New("[error] Must specify host and export.")
@@ -40,177 +111,251 @@ func NewNFSTester(nfshost string, export string, uniqueId string, concurrency in
 		return nil, errors.New("[error] Must specify positive test duration.")
 	}
 
-	nfsTester := &NFSTester{nfshost: nfshost, export: export, uniqueId: uniqueId, concurrency: concurrency, durationSeconds: duration, filesWritten: 0}
-
-	// Try and mount to verify
-	mount, err := nfs.DialMount(nfshost, false)
-	if err != nil {
-		err := errors.New("[error] Unable to dial mount service.")
-		return nil, err
+	if opts.FileSize%(1024*1024) != 0 {
+		return nil, errors.New("[error] File size must be a multiple of 1 MiB.")
 	}
-	defer mount.Close()
-
-	auth := rpc.NewAuthUnix("anon", 1001, 1001)
-
-	target, err := mount.Mount(export, auth.Auth(), false)
-	if err != nil {
-		err := errors.New("[error] Unable to mount export.")
-		return nil, err
+	if opts.FilesPerWorker > 1 && opts.FileSize == 0 {
+		return nil, errors.New("[error] Must specify a file size to use more than one file per worker.")
 	}
-	defer target.Close()
-
-	return nfsTester, err
-}
 
-func (n *NFSTester) writeOneFile(fname string) {
+	if opts.CommitBytes > 0 && opts.Stability != stabilityUnstable {
+		return nil, errors.New("[error] COMMIT is only issued with unstable writes.")
+	}
 
-	defer n.wg.Done()
+	cred := defaultNFSCredentials
+	if opts.Credentials != nil {
+		cred = *opts.Credentials
+	}
+	if len(cred.Gids) > maxAuthUnixGids {
+		return nil, fmt.Errorf("[error] At most %d supplementary groups can be sent with NFS requests.", maxAuthUnixGids)
+	}
 
-	mount, err := nfs.DialMount(n.nfshost, false)
-	if err != nil {
-		fmt.Println("Portmapper failed.")
-		fmt.Println(err)
-		return
+	nfsTester := &NFSTester{nfshost: nfshost, export: export, opts: opts}
+	nfsTester.seqTester = newSeqTester(uniqueId, concurrency, duration, seqOptions{
+		Verify:         opts.Verify,
+		Seed:           opts.Seed,
+		FileSize:       opts.FileSize,
+		FilesPerWorker: opts.FilesPerWorker,
+		SyncBytes:      opts.CommitBytes,
+		SyncOnClose:    opts.CommitBytes > 0,
+	})
+	nfsTester.files = nfsTester
+	nfsTester.source = nfshost
+	nfsTester.cred = authUnix(cred.MachineName, cred.Uid, cred.Gid, cred.Gids)
+
+	// Open all connections up front; they stay open until Close.
+	connections := opts.Connections
+	if connections < 1 {
+		connections = concurrency
 	}
-	auth := rpc.NewAuthUnix("anon", 1001, 1001)
-	target, err := mount.Mount(n.export, auth.Auth(), false)
+	err := nfsTester.mount(connections)
 	if err != nil {
-		fmt.Println("Unable to mount.")
-		fmt.Println(err)
-		return
+		return nil, fmt.Errorf("[error] Unable to mount export: %v", err)
 	}
+	client := nfsTester.conns[0].client
 
-	srcBuf := make([]byte, 1024*1024)
-	rand.Read(srcBuf)
-
-	f, err := target.OpenFile(fname, os.FileMode(int(0744)))
+	nfsTester.rtmax, nfsTester.wtmax, err = client.maxIO(nfsTester.rootFH)
 	if err != nil {
-		fmt.Printf("OpenFile %s failed\n", fname)
-		fmt.Println(err)
-		return
+		nfsTester.Close()
+		return nil, fmt.Errorf("[error] Unable to query export %s: %v", export, err)
 	}
 
-	var bytes_written uint64
-	bytes_written = 0
-
-	for atomic.LoadInt32(&n.atm_finished) == 0 {
-		n, _ := f.Write(srcBuf)
-		bytes_written += uint64(n)
+	// Size sequential calls to the server's maximum, so that each is a
+	// single RPC and its latency is that of the RPC.
+	nfsTester.writeSize = rpcSize(nfsTester.writeSize, nfsTester.wtmax)
+	nfsTester.readSize = rpcSize(nfsTester.readSize, nfsTester.rtmax)
+
+	nfsTester.dirFH = nfsTester.rootFH
+	if opts.Subdir != "" {
+		subdir := path.Clean("/" + opts.Subdir)
+		nfsTester.runDir = "run-" + uniqueId + "-" + strconv.FormatInt(time.Now().Unix(), 10)
+		runPath := path.Join(subdir, nfsTester.runDir)
+
+		// The subdir may already exist; only the per-run directory must be new.
+		nfsTester.parentFH, err = client.mkdirPath(nfsTester.rootFH, subdir, 0755)
+		if err == nil {
+			nfsTester.dirFH, err = client.mkdir(nfsTester.parentFH, nfsTester.runDir, 0755)
+		}
+		if err != nil {
+			nfsTester.Close()
+			return nil, fmt.Errorf("[error] Unable to create directory %s in export %s: %v", runPath, export, err)
+		}
+		fmt.Printf("Using directory %s in export %s\n", runPath, export)
 	}
 
-	atomic.AddUint64(&n.atm_counter_bytes_written, bytes_written)
+	return nfsTester, nil
 }
 
-func generateTestFilename(prefix string, i int) string {
-
-	baseDir := "/"
-	fname := baseDir + "filename-" + prefix + "-" + strconv.Itoa(i)
-	return fname
+// nfsFile is a test file of the sequential tests, accessed on the
+// connection of the worker that opened it. Syncing a file issues a COMMIT.
+type nfsFile struct {
+	n    *NFSTester
+	c    *nfsConn
+	fh   []byte
+	verf writeVerifier
 }
 
-func (n *NFSTester) WriteTest() float64 {
-
-	atomic.StoreInt32(&n.atm_finished, 0)
-	atomic.StoreUint64(&n.atm_counter_bytes_written, 0)
+// writeVerifier tracks the write verifier of a file's unstable WRITE and
+// COMMIT replies. A change means the server restarted, and may have lost
+// unstable writes that were not yet committed.
+type writeVerifier struct {
+	verf uint64
+	set  bool
+}
 
-	for i := 1; i <= n.concurrency; i++ {
-		fname := generateTestFilename(n.uniqueId, i)
-		n.wg.Add(1)
-		go n.writeOneFile(fname)
+func (v *writeVerifier) check(proc string, verf uint64) error {
+	if v.set && verf != v.verf {
+		v.verf = verf
+		return fmt.Errorf("%s returned a new write verifier, the server may have restarted", proc)
 	}
+	v.verf, v.set = verf, true
+	return nil
+}
 
-	time.Sleep(time.Duration(n.durationSeconds) * time.Second)
-	atomic.StoreInt32(&n.atm_finished, 1)
-	n.wg.Wait()
-	n.filesWritten += n.concurrency
+func (f *nfsFile) WriteAt(p []byte, off int64) (int, error) {
+	return f.n.writeDirect(f.c.client, f.fh, uint64(off), p, &f.verf)
+}
 
-	total_bytes := atomic.LoadUint64(&n.atm_counter_bytes_written)
-	return float64(total_bytes) / float64(n.durationSeconds)
+func (f *nfsFile) ReadAt(p []byte, off int64) (int, error) {
+	count, eof, err := f.n.readAt(f.c.client, f.fh, uint64(off), p)
+	if err == nil && eof && count < len(p) {
+		err = io.EOF
+	}
+	return count, err
 }
 
-func (n *NFSTester) readOneFile(fname string) {
+func (f *nfsFile) Sync() error {
+	verf, err := f.c.client.commit(f.fh)
+	if err != nil {
+		return err
+	}
+	return f.verf.check("COMMIT", verf)
+}
 
-	defer n.wg.Done()
+// Close does nothing, as NFSv3 has no open files.
+func (f *nfsFile) Close() error {
+	return nil
+}
 
-	mount, err := nfs.DialMount(n.nfshost, false)
+func (n *NFSTester) createFile(i int, fname string) (seqFile, error) {
+	c := n.conn(i)
+	fh, err := c.client.create(n.dirFH, fname, 0744)
 	if err != nil {
-		fmt.Println(err)
-		return
+		return nil, err
 	}
-	auth := rpc.NewAuthUnix("anon", 1001, 1001)
-	target, err := mount.Mount(n.export, auth.Auth(), false)
+	return &nfsFile{n: n, c: c, fh: fh}, nil
+}
+
+func (n *NFSTester) openFile(i int, fname string) (seqFile, error) {
+	c := n.conn(i)
+	fh, err := c.client.lookup(n.dirFH, fname)
 	if err != nil {
-		fmt.Println(err)
-		return
+		return nil, err
 	}
+	return &nfsFile{n: n, c: c, fh: fh}, nil
+}
 
-	p := make([]byte, 512*1024)
-	byte_counter := uint64(0)
-	for {
-		f, err := target.Open(fname)
+// writeDirect writes p at offset with WRITE calls of at most wtmax bytes
+// using the configured stable_how, and returns the bytes the server wrote.
+// The write verifier of unstable writes is checked against verf, if set.
+func (n *NFSTester) writeDirect(client *nfsClient, fh []byte, offset uint64, p []byte, verf *writeVerifier) (int, error) {
+	stable := n.stableHow()
+
+	written := 0
+	for written < len(p) {
+		chunk := p[written:]
+		if len(chunk) > int(n.wtmax) {
+			chunk = chunk[:n.wtmax]
+		}
+		count, wverf, err := client.write(fh, offset+uint64(written), chunk, stable)
+		written += count
+		if err == nil && verf != nil && stable == nfs3Unstable {
+			err = verf.check("WRITE", wverf)
+		}
 		if err != nil {
-			fmt.Println(err)
-			return
+			return written, err
 		}
-
-		for {
-			if atomic.LoadInt32(&n.atm_finished) == 1 {
-				atomic.AddUint64(&n.atm_counter_bytes_read, byte_counter)
-				return
-			}
-
-			n, err := f.Read(p)
-			if err == io.EOF {
-				break
-			}
-			byte_counter += uint64(n)
+		if count == 0 {
+			return written, errors.New("WRITE made no progress")
 		}
 	}
+	return written, nil
 }
 
-func (n *NFSTester) ReadTest() float64 {
-
-	if n.filesWritten == 0 {
-		fmt.Println("[error] Unable to perform ReadTest, no files written.")
-		return float64(0)
+// readAt reads into p at offset with READ calls of at most rtmax bytes,
+// stopping early at the end of file, and returns the bytes read and whether
+// they reach the end of file.
+func (n *NFSTester) readAt(client *nfsClient, fh []byte, offset uint64, p []byte) (int, bool, error) {
+	read := 0
+	for read < len(p) {
+		chunk := p[read:]
+		if len(chunk) > int(n.rtmax) {
+			chunk = chunk[:n.rtmax]
+		}
+		count, eof, err := client.read(fh, offset+uint64(read), chunk)
+		read += count
+		if err != nil || eof {
+			return read, eof, err
+		}
+		if count == 0 {
+			return read, false, errors.New("READ made no progress")
+		}
 	}
-	atomic.StoreInt32(&n.atm_finished, 0)
-	atomic.StoreUint64(&n.atm_counter_bytes_read, 0)
+	return read, false, nil
+}
 
-	for i := 1; i <= n.filesWritten; i++ {
-		fname := generateTestFilename(n.uniqueId, i)
-		n.wg.Add(1)
-		go n.readOneFile(fname)
+// rpcSize returns size limited to max, rounded down to whole verification
+// blocks where possible.
+func rpcSize(size int, max uint32) int {
+	if size > int(max) {
+		size = int(max)
+		if size >= verifyBlockSize {
+			size -= size % verifyBlockSize
+		}
 	}
+	return size
+}
 
-	time.Sleep(time.Duration(n.durationSeconds) * time.Second)
-	atomic.StoreInt32(&n.atm_finished, 1)
-	n.wg.Wait()
+// stableHow is the stable_how of WRITE calls.
+func (n *NFSTester) stableHow() uint32 {
+	if n.opts.Stability == stabilityFileSync {
+		return nfs3FileSync
+	}
+	return nfs3Unstable
+}
 
-	total_bytes := atomic.LoadUint64(&n.atm_counter_bytes_read)
-	return float64(total_bytes) / float64(n.durationSeconds)
+// CommitResult returns the COMMIT calls of the last write test, if any were
+// issued.
+func (n *NFSTester) CommitResult() (OperationResult, bool) {
+	return n.syncResult("COMMIT")
 }
 
+// Cleanup removes the test files, and the per-run directory if one was
+// created, returning any errors. The pooled connections redial if they have
+// failed since the tests.
 func (n *NFSTester) Cleanup() error {
-	mount, err := nfs.DialMount(n.nfshost, false)
-	if err != nil {
-		return err
-	}
-	auth := rpc.NewAuthUnix("anon", 1001, 1001)
-	target, err := mount.Mount(n.export, auth.Auth(), false)
-	if err != nil {
-		return err
-	}
-
-	for i := 1; i <= n.concurrency; i++ {
-		fname := generateTestFilename(n.uniqueId, i)
+	var mu sync.Mutex
+	var errs []error
+	for i := 1; i <= n.filesWritten; i++ {
+		fname := generateTestFilename("", n.uniqueId, i)
 		n.wg.Add(1)
 
-		go func(filename string) {
+		go func(c *nfsConn, filename string) {
 			defer n.wg.Done()
-			target.Remove(filename)
-		}(fname)
+			if err := c.client.remove(n.dirFH, filename); err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("[error] Unable to remove %s: %v", filename, err))
+				mu.Unlock()
+			}
+		}(n.conn(i), fname)
 	}
 	n.wg.Wait()
-	return nil
+
+	if n.runDir != "" {
+		c := n.conns[0]
+		if err := c.client.rmdir(n.parentFH, n.runDir); err != nil {
+			errs = append(errs, fmt.Errorf("[error] Unable to remove directory %s: %v", n.runDir, err))
+		}
+	}
+	return joinErrors(errs...)
 }
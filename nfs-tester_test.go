@@ -0,0 +1,357 @@
+package main
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testNFSOptions returns options for a small, bounded working set, with the
+// credentials the test server's export root belongs to.
+func testNFSOptions() NFSOptions {
+	return NFSOptions{
+		Credentials:    &NFSCredentials{Uid: 1001, Gid: 1001, MachineName: "test"},
+		Verify:         true,
+		Seed:           1,
+		FileSize:       2 * 1024 * 1024,
+		FilesPerWorker: 2,
+	}
+}
+
+func TestNewNFSTesterMountFailure(t *testing.T) {
+	s := startTestNFSServer(t, "/fs")
+
+	_, err := NewNFSTester(s.addr(), "/missing", "test", 2, 1, testNFSOptions())
+	if err == nil || !strings.Contains(err.Error(), "Unable to mount export") || !strings.Contains(err.Error(), "no such export") {
+		t.Errorf("mounting an unknown export: got %v", err)
+	}
+
+	// Nothing listens on port 1, so the portmapper cannot be reached.
+	_, err = NewNFSTester("127.0.0.1:1", "/fs", "test", 2, 1, testNFSOptions())
+	if err == nil || !strings.Contains(err.Error(), "Unable to mount export") {
+		t.Errorf("mounting without a portmapper: got %v", err)
+	}
+}
+
+func TestNFSTesterWriteReadCleanup(t *testing.T) {
+	s := startTestNFSServer(t, "/fs")
+
+	n, err := NewNFSTester(s.addr(), "/fs", "test", 2, 1, testNFSOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	write := n.WriteTest()
+	if write.BytesPerSec == 0 || write.FailedOps != 0 {
+		t.Errorf("write test: %+v", write)
+	}
+	if got := len(s.rootEntries(t, "/fs")); got != 4 {
+		t.Errorf("write test created %d files, want 4", got)
+	}
+
+	read := n.ReadTest()
+	if read.BytesPerSec == 0 || read.FailedOps != 0 {
+		t.Errorf("read test: %+v", read)
+	}
+	if !read.Verified || read.Mismatches != 0 {
+		t.Errorf("read test verification: %+v", read)
+	}
+
+	if err := n.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if names := s.rootEntries(t, "/fs"); len(names) != 0 {
+		t.Errorf("cleanup left %v", names)
+	}
+}
+
+func TestNFSTesterSubdirCleanup(t *testing.T) {
+	s := startTestNFSServer(t, "/fs")
+	opts := testNFSOptions()
+	opts.Subdir = "bench"
+
+	n, err := NewNFSTester(s.addr(), "/fs", "test", 1, 1, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+	n.WriteTest()
+	if err := n.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	// Only the per-run directory is removed.
+	if names := s.rootEntries(t, "/fs"); len(names) != 1 || names[0] != "bench" {
+		t.Errorf("export root holds %v after cleanup, want [bench]", names)
+	}
+	if names := s.entries(t, n.parentFH); len(names) != 0 {
+		t.Errorf("cleanup left %v", names)
+	}
+}
+
+func TestNFSTesterPermissionDenied(t *testing.T) {
+	s := startTestNFSServer(t, "/fs")
+	opts := testNFSOptions()
+	opts.Credentials = &NFSCredentials{Uid: 2000, Gid: 2000, MachineName: "test"}
+
+	// Creating the per-run directory in the export root fails.
+	opts.Subdir = "bench"
+	_, err := NewNFSTester(s.addr(), "/fs", "test", 1, 1, opts)
+	if err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("creating a subdir without permission: got %v", err)
+	}
+
+	// Without a subdir, writers cannot create their files.
+	opts.Subdir = ""
+	n, err := NewNFSTester(s.addr(), "/fs", "test", 2, 1, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+	if write := n.WriteTest(); write.BytesPerSec != 0 {
+		t.Errorf("write test without permission: %+v", write)
+	}
+	if names := s.rootEntries(t, "/fs"); len(names) != 0 {
+		t.Errorf("write test without permission created %v", names)
+	}
+}
+
+func TestNFSTesterSharedConnection(t *testing.T) {
+	s := startTestNFSServer(t, "/fs")
+	s.set(func() { s.latency = 5 * time.Millisecond })
+	opts := testNFSOptions()
+	opts.Connections = 1
+
+	n, err := NewNFSTester(s.addr(), "/fs", "test", 4, 1, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+	if write := n.WriteTest(); write.BytesPerSec == 0 || write.FailedOps != 0 {
+		t.Errorf("write test: %+v", write)
+	}
+	if conns := s.connCount(); conns != 1 {
+		t.Errorf("opened %d NFS connections, want 1", conns)
+	}
+	// The workers' calls take turns on the one connection.
+	if max := atomic.LoadInt32(&s.maxInFlight); max != 1 {
+		t.Errorf("%d calls were in flight at once on one connection", max)
+	}
+}
+
+func TestNFSTesterLatencyPerRPC(t *testing.T) {
+	s := startTestNFSServer(t, "/fs")
+	s.set(func() { s.rtmax, s.wtmax = 64*1024, 64*1024 })
+
+	n, err := NewNFSTester(s.addr(), "/fs", "test", 2, 1, testNFSOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	// Each timed call is one WRITE or READ, however small the server's
+	// maximum.
+	write := n.WriteTest()
+	if got, want := write.Latency.Count, uint64(s.callCount(nfsProc3Write)); got != want {
+		t.Errorf("write latency counts %d calls, server handled %d WRITEs", got, want)
+	}
+	read := n.ReadTest()
+	if got, want := read.Latency.Count, uint64(s.callCount(nfsProc3Read)); got != want {
+		t.Errorf("read latency counts %d calls, server handled %d READs", got, want)
+	}
+	if !read.Verified || read.Mismatches != 0 {
+		t.Errorf("read test verification: %+v", read)
+	}
+}
+
+func TestNFSTesterFileSyncNotCommitted(t *testing.T) {
+	s := startTestNFSServer(t, "/fs")
+	unstable := uint32(nfs3Unstable)
+	s.set(func() { s.committed = &unstable })
+	opts := testNFSOptions()
+	opts.Stability = stabilityFileSync
+
+	n, err := NewNFSTester(s.addr(), "/fs", "test", 1, 1, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+	// Writes the server does not commit to stable storage fail.
+	if write := n.WriteTest(); write.BytesPerSec != 0 || write.FailedOps == 0 {
+		t.Errorf("write test with uncommitted FILE_SYNC writes: %+v", write)
+	}
+}
+
+func TestNFSTesterWriteVerifierChange(t *testing.T) {
+	s := startTestNFSServer(t, "/fs")
+	opts := testNFSOptions()
+	opts.CommitBytes = 1024 * 1024
+
+	n, err := NewNFSTester(s.addr(), "/fs", "test", 1, 1, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+	f, err := n.createFile(1, "verf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := make([]byte, 4096)
+	if _, err := f.WriteAt(p, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server restarts between the write and its COMMIT.
+	s.set(func() { s.verf++ })
+	if err := f.Sync(); err == nil || !strings.Contains(err.Error(), "new write verifier") {
+		t.Errorf("COMMIT after a restart: got %v", err)
+	}
+	if _, err := f.WriteAt(p, 0); err != nil {
+		t.Errorf("rewriting after a restart: %v", err)
+	}
+	if err := f.Sync(); err != nil {
+		t.Errorf("COMMIT of the rewritten data: %v", err)
+	}
+}
+
+func TestNFSTesterReadMissingFile(t *testing.T) {
+	s := startTestNFSServer(t, "/fs")
+
+	n, err := NewNFSTester(s.addr(), "/fs", "test", 2, 1, testNFSOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+	n.WriteTest()
+
+	// A reader that cannot open one of its files fails it and goes on
+	// reading the others.
+	if err := n.conns[0].client.remove(n.dirFH, generateTestFilename("", "test", 1)); err != nil {
+		t.Fatal(err)
+	}
+	read := n.ReadTest()
+	if read.FailedOps != 1 {
+		t.Errorf("read test failed %d operations, want 1", read.FailedOps)
+	}
+	if read.BytesPerSec == 0 || read.Mismatches != 0 {
+		t.Errorf("read test: %+v", read)
+	}
+}
+
+func TestNFSTesterDefaultCredentials(t *testing.T) {
+	s := startTestNFSServer(t, "/fs")
+
+	n, err := NewNFSTester(s.addr(), "/fs", "test", 1, 1, NFSOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.creds) == 0 {
+		t.Fatal("no NFS calls were made")
+	}
+	for _, c := range s.creds {
+		if c.machineName != "anon" || c.uid != 1001 || c.gid != 1001 || len(c.gids) != 0 {
+			t.Fatalf("sent credentials %+v, want anon 1001/1001", c)
+		}
+	}
+}
+
+func TestNFSTesterNestedSubdir(t *testing.T) {
+	s := startTestNFSServer(t, "/fs")
+	opts := testNFSOptions()
+	opts.Subdir = "a/b/c"
+
+	for run := 0; run < 2; run++ {
+		// The second run finds the subdir already in place.
+		n, err := NewNFSTester(s.addr(), "/fs", "test", 1, 1, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := n.Cleanup(); err != nil {
+			t.Fatal(err)
+		}
+		n.Close()
+	}
+	if names := s.rootEntries(t, "/fs"); len(names) != 1 || names[0] != "a" {
+		t.Errorf("export root holds %v, want [a]", names)
+	}
+}
+
+func TestNFSTesterCallTimeout(t *testing.T) {
+	s := startTestNFSServer(t, "/fs")
+
+	n, err := NewNFSTester(s.addr(), "/fs", "test", 1, 1, testNFSOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	defer func(timeout time.Duration) { rpcTimeout = timeout }(rpcTimeout)
+	rpcTimeout = 50 * time.Millisecond
+	s.set(func() { s.latency = time.Second })
+
+	// A stalled server fails the call once the timeout passes.
+	start := time.Now()
+	_, err = n.conns[0].client.getattr(n.rootFH)
+	if err == nil || !strings.Contains(err.Error(), "no reply") {
+		t.Errorf("getattr on a stalled server: got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("getattr on a stalled server returned after %v", elapsed)
+	}
+}
+
+func TestNFSTesterRedial(t *testing.T) {
+	s := startTestNFSServer(t, "/fs")
+
+	n, err := NewNFSTester(s.addr(), "/fs", "test", 1, 1, testNFSOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	defer func(timeout time.Duration) { rpcTimeout = timeout }(rpcTimeout)
+	rpcTimeout = 50 * time.Millisecond
+	s.set(func() { s.latency = 200 * time.Millisecond })
+	if _, err := n.conns[0].client.getattr(n.rootFH); err == nil {
+		t.Fatal("getattr on a stalled server succeeded")
+	}
+
+	// The call that timed out closed the connection, and the next call
+	// redials it.
+	s.set(func() { s.latency = 0 })
+	if _, err := n.conns[0].client.getattr(n.rootFH); err != nil {
+		t.Errorf("getattr after the server recovered: %v", err)
+	}
+	if conns := s.connCount(); conns != 2 {
+		t.Errorf("opened %d NFS connections, want 2", conns)
+	}
+}
+
+func TestNFSTesterCleanupErrors(t *testing.T) {
+	s := startTestNFSServer(t, "/fs")
+
+	n, err := NewNFSTester(s.addr(), "/fs", "test", 2, 1, testNFSOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+	n.WriteTest()
+
+	missing := generateTestFilename("", "test", 1)
+	if err := n.conns[0].client.remove(n.dirFH, missing); err != nil {
+		t.Fatal(err)
+	}
+	// The file already removed is reported, and the others are removed.
+	err = n.Cleanup()
+	if err == nil || !strings.Contains(err.Error(), missing) {
+		t.Errorf("cleanup with a missing file: got %v", err)
+	}
+	if names := s.rootEntries(t, "/fs"); len(names) != 0 {
+		t.Errorf("cleanup left %v", names)
+	}
+}
@@ -0,0 +1,33 @@
+//go:build amd64 || arm64
+// +build amd64 arm64
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// POSIX_FADV_DONTNEED
+const fadvDontNeed = 4
+
+// dropCachedPages writes a file's dirty pages back and asks the kernel to
+// evict the file from the page cache, so that later reads reach the
+// filesystem.
+func dropCachedPages(fname string) error {
+	f, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Only clean pages are evicted.
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_FADVISE64, f.Fd(), 0, 0, fadvDontNeed, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
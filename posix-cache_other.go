@@ -0,0 +1,11 @@
+//go:build !linux || !(amd64 || arm64)
+// +build !linux !amd64,!arm64
+
+package main
+
+import "errors"
+
+// dropCachedPages is only implemented on Linux.
+func dropCachedPages(fname string) error {
+	return errors.New("evicting files from the page cache is not supported on this platform")
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// POSIXOptions holds optional POSIXTester settings, with the same meaning as
+// the corresponding NFSOptions.
+type POSIXOptions struct {
+	Verify bool
+	Seed   uint64
+
+	FileSize       uint64
+	FilesPerWorker int
+}
+
+// POSIXTester runs the NFS write and read workloads with ordinary file IO on
+// a locally mounted path, so that the kernel NFS client and its mount options
+// can be compared with the userspace client. Each file is fsynced whenever
+// its writer moves on from it, so that data buffered by the kernel reaches
+// the server within the test.
+type POSIXTester struct {
+	seqTester
+
+	root    string
+	baseDir string
+
+	// Server and mount options of the mount containing root, if known.
+	mountSource  string
+	mountOptions string
+}
+
+func NewPOSIXTester(root string, uniqueId string, concurrency int, duration int, opts POSIXOptions) (*POSIXTester, error) {
+
+	if len(root) == 0 {
+		return nil, errors.New("[error] Must specify path.")
+	}
+	if duration < 1 {
+		return nil, errors.New("[error] Must specify positive test duration.")
+	}
+	if opts.FilesPerWorker > 1 && opts.FileSize == 0 {
+		return nil, errors.New("[error] Must specify a file size to use more than one file per worker.")
+	}
+
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, fmt.Errorf("[error] Unable to access %s: %v", root, err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("[error] %s is not a directory.", root)
+	}
+
+	p := &POSIXTester{root: root}
+	p.seqTester = newSeqTester(uniqueId, concurrency, duration, seqOptions{
+		Verify:         opts.Verify,
+		Seed:           opts.Seed,
+		FileSize:       opts.FileSize,
+		FilesPerWorker: opts.FilesPerWorker,
+		SyncOnClose:    true,
+	})
+	p.files = p
+	p.baseDir = filepath.Join(root, "run-"+uniqueId+"-"+strconv.FormatInt(time.Now().Unix(), 10))
+	if err := os.Mkdir(p.baseDir, 0755); err != nil {
+		return nil, fmt.Errorf("[error] Unable to create directory %s: %v", p.baseDir, err)
+	}
+	p.namePrefix = p.baseDir + "/"
+
+	p.mountSource, p.mountOptions = findMount(root)
+	p.source = p.DataVip()
+	return p, nil
+}
+
+// findMount returns the source and options of the mount containing dir, as
+// listed in /proc/mounts, or empty strings where that is unavailable.
+func findMount(dir string) (string, string) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", ""
+	}
+	if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+		abs = resolved
+	}
+
+	f, err := os.Open("/proc/mounts")
+	if err != nil {
+		return "", ""
+	}
+	defer f.Close()
+
+	source, options, best := "", "", -1
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		mountpoint := fields[1]
+		if abs != mountpoint && !strings.HasPrefix(abs, strings.TrimSuffix(mountpoint, "/")+"/") {
+			continue
+		}
+		if len(mountpoint) > best {
+			source, options, best = fields[0], fields[3], len(mountpoint)
+		}
+	}
+	return source, options
+}
+
+// DataVip returns the server of an NFS mount containing the test path, or the
+// path itself if the mount is not NFS.
+func (p *POSIXTester) DataVip() string {
+	if i := strings.LastIndex(p.mountSource, ":"); i > 0 {
+		return strings.Trim(p.mountSource[:i], "[]")
+	}
+	return p.root
+}
+
+// MountDescription returns the mount source and options, for reporting.
+func (p *POSIXTester) MountDescription() string {
+	if p.mountSource == "" {
+		return "unknown mount"
+	}
+	return p.mountSource + " (" + p.mountOptions + ")"
+}
+
+func (p *POSIXTester) createFile(i int, fname string) (seqFile, error) {
+	return os.OpenFile(fname, os.O_RDWR|os.O_CREATE, 0744)
+}
+
+func (p *POSIXTester) openFile(i int, fname string) (seqFile, error) {
+	return os.Open(fname)
+}
+
+// ReadTest evicts the files of the last write test from the page cache and
+// then reads them, so that the reads reach the filesystem rather than being
+// served from the memory the writes left behind.
+func (p *POSIXTester) ReadTest() PhaseResult {
+	for _, fnames := range p.created {
+		for _, fname := range fnames {
+			if err := dropCachedPages(fname); err != nil {
+				fmt.Printf("Unable to evict %s from the page cache, reads may be served from memory: %v\n", fname, err)
+			}
+		}
+	}
+	return p.seqTester.ReadTest()
+}
+
+// FsyncResult returns the fsync calls of the last write test.
+func (p *POSIXTester) FsyncResult() (OperationResult, bool) {
+	return p.syncResult("FSYNC")
+}
+
+// Cleanup removes the per-run directory and everything in it.
+func (p *POSIXTester) Cleanup() error {
+	return os.RemoveAll(p.baseDir)
+}
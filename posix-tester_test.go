@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestPOSIXTesterWriteReadCleanup(t *testing.T) {
+	root, err := ioutil.TempDir("", "posix-tester")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	p, err := NewPOSIXTester(root, "test", 2, 1, POSIXOptions{Verify: true, Seed: 1, FileSize: 2 * 1024 * 1024, FilesPerWorker: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write := p.WriteTest()
+	if write.BytesPerSec == 0 || write.FailedOps != 0 {
+		t.Errorf("write test: %+v", write)
+	}
+	// Every file a writer moved on from was fsynced.
+	fsyncs, ok := p.FsyncResult()
+	if !ok || fsyncs.Ops < 4 || fsyncs.FailedOps != 0 {
+		t.Errorf("fsyncs: %+v", fsyncs)
+	}
+
+	read := p.ReadTest()
+	if read.BytesPerSec == 0 || read.FailedOps != 0 || !read.Verified || read.Mismatches != 0 {
+		t.Errorf("read test: %+v", read)
+	}
+
+	if err := p.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := ioutil.ReadDir(root); len(entries) != 0 {
+		t.Errorf("cleanup left %d entries", len(entries))
+	}
+}
+
+func TestDropCachedPages(t *testing.T) {
+	f, err := ioutil.TempFile("", "posix-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Write(make([]byte, 1024*1024))
+	f.Close()
+
+	if err := dropCachedPages(f.Name()); err != nil {
+		t.Errorf("dropCachedPages: %v", err)
+	}
+	if err := dropCachedPages(f.Name() + "-missing"); err == nil {
+		t.Error("dropCachedPages of a missing file succeeded")
+	}
+}
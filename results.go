@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// PhaseResult summarizes one timed test phase (for example, a write test).
+// Only operations that completed successfully contribute to BytesPerSec and
+// Latency; failed operations and the bytes they transferred are reported
+// separately.
+type PhaseResult struct {
+	BytesPerSec float64        `json:"bytes_per_sec"`
+	FailedOps   uint64         `json:"failed_ops"`
+	FailedBytes uint64         `json:"failed_bytes"`
+	Latency     LatencySummary `json:"latency"`
+
+	// Verified is set if every block read was checked against the expected
+	// content, with Mismatches counting the blocks that did not match.
+	Verified   bool   `json:"verified"`
+	Mismatches uint64 `json:"mismatches"`
+
+	// ConnectionsOpened counts the TCP connections opened during the phase,
+	// where the tester tracks them.
+	ConnectionsOpened uint64 `json:"connections_opened,omitempty"`
+
+	// Timing breaks down the latency of the phase's HTTP requests, where
+	// the tester traces them.
+	Timing *RequestTiming `json:"request_timing,omitempty"`
+}
+
+func newPhaseResult(totalBytes uint64, failedOps uint64, failedBytes uint64, latency *latencyHistogram, durationSeconds int) PhaseResult {
+	return newPhaseResultElapsed(totalBytes, failedOps, failedBytes, latency, time.Duration(durationSeconds)*time.Second)
+}
+
+// newPhaseResultElapsed is newPhaseResult for a phase whose throughput is
+// measured over elapsed rather than the test duration.
+func newPhaseResultElapsed(totalBytes uint64, failedOps uint64, failedBytes uint64, latency *latencyHistogram, elapsed time.Duration) PhaseResult {
+	return PhaseResult{
+		BytesPerSec: float64(totalBytes) / elapsed.Seconds(),
+		FailedOps:   failedOps,
+		FailedBytes: failedBytes,
+		Latency:     latency.Summary(),
+	}
+}
+
+// reportPhase prints the throughput of a phase and, if any operations failed,
+// how much was excluded from the throughput number.
+func reportPhase(name string, r PhaseResult) {
+	fmt.Printf("%s Throughput = %s\n", name, ByteRateSI(r.BytesPerSec))
+	if r.Latency.Count > 0 {
+		l := r.Latency
+		fmt.Printf("%s Latency p50 = %s, p90 = %s, p99 = %s, p99.9 = %s, max = %s\n", name,
+			formatLatency(l.P50), formatLatency(l.P90), formatLatency(l.P99), formatLatency(l.P999), formatLatency(l.Max))
+	}
+	if r.Timing != nil {
+		fmt.Printf("%s Request Timing p50/p99: %s\n", name, formatRequestTiming(r.Timing))
+	}
+	if r.ConnectionsOpened > 0 {
+		fmt.Printf("%s Connections opened = %d\n", name, r.ConnectionsOpened)
+	}
+	if r.FailedOps > 0 {
+		fmt.Printf("WARNING. %d %s operations failed, excluded %d bytes from throughput.\n", r.FailedOps, strings.ToLower(name), r.FailedBytes)
+	}
+	if r.Verified {
+		if r.Mismatches > 0 {
+			fmt.Printf("ERROR. Data verification found %d corrupt or misplaced blocks.\n", r.Mismatches)
+		} else {
+			fmt.Println("Data verification found no mismatches.")
+		}
+	}
+}
+
+// MixedResult is a phase of concurrent reads and writes, with the reads and
+// writes each summarized like a phase of their own.
+type MixedResult struct {
+	ReadPercent int         `json:"read_percent"`
+	Read        PhaseResult `json:"read"`
+	Write       PhaseResult `json:"write"`
+
+	// ConnectionsOpened and Timing cover the reads and writes together,
+	// where the tester tracks them.
+	ConnectionsOpened uint64         `json:"connections_opened,omitempty"`
+	Timing            *RequestTiming `json:"request_timing,omitempty"`
+}
+
+// reportMixed prints the read and write halves of a mixed phase and their
+// combined throughput.
+func reportMixed(r MixedResult) {
+	reportPhase("Mixed Read", r.Read)
+	reportPhase("Mixed Write", r.Write)
+	fmt.Printf("Mixed Combined Throughput = %s\n", ByteRateSI(r.Read.BytesPerSec+r.Write.BytesPerSec))
+	if r.Timing != nil {
+		fmt.Printf("Mixed Request Timing p50/p99: %s\n", formatRequestTiming(r.Timing))
+	}
+	if r.ConnectionsOpened > 0 {
+		fmt.Printf("Mixed Connections opened = %d\n", r.ConnectionsOpened)
+	}
+}
+
+func formatLatency(d time.Duration) string {
+	return d.Round(time.Microsecond).String()
+}
+
+// OperationResult summarizes an operations-per-second phase for one type of
+// operation, such as S3 HEAD requests.
+type OperationResult struct {
+	Operation string         `json:"operation"`
+	Ops       uint64         `json:"ops"`
+	OpsPerSec float64        `json:"ops_per_sec"`
+	FailedOps uint64         `json:"failed_ops"`
+	Latency   LatencySummary `json:"latency"`
+
+	// Items counts what each operation returned, for operations like LIST
+	// that return many keys per request.
+	Items       uint64  `json:"items,omitempty"`
+	ItemsPerSec float64 `json:"items_per_sec,omitempty"`
+
+	// TTFB is the time to the first byte of the response, for operations
+	// that measure it separately from Latency.
+	TTFB *LatencySummary `json:"ttfb,omitempty"`
+
+	// ConnectionsOpened counts the TCP connections opened during the
+	// operation's phase, where the tester tracks them.
+	ConnectionsOpened uint64 `json:"connections_opened,omitempty"`
+}
+
+func newOperationResult(name string, ops uint64, failedOps uint64, latency *latencyHistogram, elapsed time.Duration) OperationResult {
+	return OperationResult{
+		Operation: name,
+		Ops:       ops,
+		OpsPerSec: float64(ops) / elapsed.Seconds(),
+		FailedOps: failedOps,
+		Latency:   latency.Summary(),
+	}
+}
+
+// reportOperation prints the rate and latency of an operations phase.
+func reportOperation(r OperationResult) {
+	fmt.Printf("%s: %.1f ops/s, p50 = %s, p99 = %s", r.Operation, r.OpsPerSec, formatLatency(r.Latency.P50), formatLatency(r.Latency.P99))
+	if r.Items > 0 {
+		fmt.Printf(", %.1f items/s", r.ItemsPerSec)
+	}
+	if r.TTFB != nil {
+		fmt.Printf(", ttfb p50 = %s, p99 = %s", formatLatency(r.TTFB.P50), formatLatency(r.TTFB.P99))
+	}
+	if r.ConnectionsOpened > 0 {
+		fmt.Printf(", %d connections opened", r.ConnectionsOpened)
+	}
+	if r.FailedOps > 0 {
+		fmt.Printf(", %d failed", r.FailedOps)
+	}
+	fmt.Println()
+}
+
+// TestResult is one row of the final results table: a single protocol tested
+// against a single data VIP.
+type TestResult struct {
+	DataVip  string       `json:"data_vip"`
+	SourceIP string       `json:"source_ip,omitempty"`
+	Protocol string       `json:"protocol"`
+	Result   string       `json:"result"`
+	Write    *PhaseResult `json:"write,omitempty"`
+	Read     *PhaseResult `json:"read,omitempty"`
+
+	// Multipart is the S3 multipart upload test, if run.
+	Multipart *PhaseResult `json:"multipart,omitempty"`
+	// RangedRead is the S3 ranged GET test, if run.
+	RangedRead *PhaseResult `json:"ranged_read,omitempty"`
+	// Mixed is the mixed read and write test, if run.
+	Mixed *MixedResult `json:"mixed,omitempty"`
+
+	Operations []OperationResult `json:"operations,omitempty"`
+}
+
+const resultsHeader = "dataVip,protocol,result,write_tput,read_tput,failed_ops,mismatches," +
+	"write_p50,write_p90,write_p99,write_p99.9,write_max," +
+	"read_p50,read_p90,read_p99,read_p99.9,read_max,source_ip"
+
+// sourceColumn is the local source address, or "-" if the kernel chose it.
+func (r TestResult) sourceColumn() string {
+	if r.SourceIP == "" {
+		return "-"
+	}
+	return r.SourceIP
+}
+
+// latencyColumns formats the latency percentiles, or dashes if no latency
+// was recorded.
+func latencyColumns(l LatencySummary) string {
+	if l.Count == 0 {
+		return "-,-,-,-,-"
+	}
+	return strings.Join([]string{formatLatency(l.P50), formatLatency(l.P90), formatLatency(l.P99), formatLatency(l.P999), formatLatency(l.Max)}, ",")
+}
+
+func (r TestResult) String() string {
+	if r.Write == nil || r.Read == nil {
+		return fmt.Sprintf("%s,%s,%s,-,-,-,-,-,-,-,-,-,-,-,-,-,-,%s", r.DataVip, r.Protocol, r.Result, r.sourceColumn())
+	}
+	mismatches := "-"
+	if r.Read.Verified {
+		mismatches = fmt.Sprintf("%d", r.Read.Mismatches)
+	}
+	return fmt.Sprintf("%s,%s,%s,%s,%s,%d,%s,%s,%s,%s", r.DataVip, r.Protocol, r.Result,
+		ByteRateSI(r.Write.BytesPerSec), ByteRateSI(r.Read.BytesPerSec), r.Write.FailedOps+r.Read.FailedOps, mismatches,
+		latencyColumns(r.Write.Latency), latencyColumns(r.Read.Latency), r.sourceColumn())
+}
+
+const operationsHeader = "dataVip,protocol,operation,ops_per_sec,items_per_sec,failed_ops,p50,p90,p99,p99.9,max,source_ip"
+
+// operationRows formats the operations-per-second results as rows of a second
+// table, following the main results table.
+func (r TestResult) operationRows() []string {
+	var rows []string
+	for _, op := range r.Operations {
+		items := "-"
+		if op.Items > 0 {
+			items = fmt.Sprintf("%.1f", op.ItemsPerSec)
+		}
+		rows = append(rows, fmt.Sprintf("%s,%s,%s,%.1f,%s,%d,%s,%s", r.DataVip, r.Protocol, op.Operation, op.OpsPerSec, items, op.FailedOps, latencyColumns(op.Latency), r.sourceColumn()))
+	}
+	return rows
+}
+
+func writeResultsJSON(path string, results []TestResult) error {
+	data, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+// s3Credentials returns the credentials for the tester's sessions: the given
+// keys if set, else the named profile or credentials file if either is set,
+// else nil to use the SDK's default chain.
+func (s *S3Tester) s3Credentials() *credentials.Credentials {
+	if s.accessKey != "" {
+		return credentials.NewStaticCredentials(s.accessKey, s.secretKey, "")
+	}
+	if s.opts.Profile != "" || s.opts.CredentialsFile != "" {
+		return credentials.NewSharedCredentials(s.opts.CredentialsFile, s.opts.Profile)
+	}
+	return nil
+}
+
+// maskAccessKey shows only the start of an access key id.
+func maskAccessKey(key string) string {
+	if len(key) <= 8 {
+		return strings.Repeat("*", len(key))
+	}
+	return key[:8] + strings.Repeat("*", len(key)-8)
+}
+
+// s3ErrorHints explains the S3 error codes caused by client configuration.
+var s3ErrorHints = map[string]string{
+	"SignatureDoesNotMatch": "The secret key does not match the access key, or the request was signed for a different region or altered in transit. Check the secret key and --s3-region.",
+	"InvalidAccessKeyId":    "The endpoint does not know this access key. Check that the key belongs to an object store user on this FlashBlade and has not been deleted.",
+	"RequestTimeTooSkewed":  "The client clock differs too much from the server's. Synchronize the client clock, for example with NTP.",
+}
+
+// diagnoseS3Error returns a hint for errors caused by credentials or client
+// configuration, or an empty string. Errors wrapped by the SDK, such as the
+// part failure within an s3manager.MultiUploadFailure, are diagnosed too.
+func diagnoseS3Error(err error) string {
+	for err != nil {
+		aerr, ok := err.(awserr.Error)
+		if !ok {
+			return ""
+		}
+		if hint, ok := s3ErrorHints[aerr.Code()]; ok {
+			return hint
+		}
+		err = aerr.OrigErr()
+	}
+	return ""
+}
+
+// printS3Error prints an S3 error with a diagnosis if one is known.
+func printS3Error(msg string, err error) {
+	fmt.Println(msg, err)
+	if hint := diagnoseS3Error(err); hint != "" {
+		fmt.Println("HINT. " + hint)
+	}
+}
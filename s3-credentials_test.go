@@ -0,0 +1,29 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+func TestDiagnoseS3Error(t *testing.T) {
+	skew := s3ErrorHints["RequestTimeTooSkewed"]
+	signature := s3ErrorHints["SignatureDoesNotMatch"]
+	for _, c := range []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"plain", errors.New("connection refused"), ""},
+		{"code", awserr.New("RequestTimeTooSkewed", "skewed", nil), skew},
+		{"request failure", awserr.NewRequestFailure(awserr.New("SignatureDoesNotMatch", "bad", nil), 403, "id"), signature},
+		// As s3manager reports a failed part of a multipart upload.
+		{"multipart", awserr.New("MultipartUpload", "upload multipart failed", awserr.New("RequestTimeTooSkewed", "skewed", nil)), skew},
+		{"wrapped unknown", awserr.New("RequestError", "send request failed", errors.New("EOF")), ""},
+	} {
+		if got := diagnoseS3Error(c.err); got != c.want {
+			t.Errorf("%s: diagnoseS3Error(%v) = %q, want %q", c.name, c.err, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+func generateListPrefix(prefix string) string {
+	return "listobj-" + prefix + "/"
+}
+
+// generateListObjectName spreads keys over fanout sub-prefixes so that a
+// delimited listing sees a two-level hierarchy.
+func generateListObjectName(prefix string, fanout int, i int) string {
+	return generateListPrefix(prefix) + "dir-" + strconv.Itoa(i%fanout) + "/key-" + strconv.Itoa(i)
+}
+
+// listPages lists everything under prefix, following continuation tokens, and
+// records each page request into latency. It returns the number of pages and
+// the number of keys plus common prefixes returned.
+func (s *S3Tester) listPages(svc *s3.S3, prefix string, delimiter string, maxKeys int, latency *latencyHistogram) (uint64, uint64, []string, error) {
+
+	pages, items := uint64(0), uint64(0)
+	var commonPrefixes []string
+
+	input := &s3.ListObjectsV2Input{
+		Bucket:  &s.bucket,
+		Prefix:  aws.String(prefix),
+		MaxKeys: aws.Int64(int64(maxKeys)),
+	}
+	if delimiter != "" {
+		input.Delimiter = aws.String(delimiter)
+	}
+
+	for {
+		start := time.Now()
+		out, err := svc.ListObjectsV2(input)
+		if err != nil {
+			return pages, items, commonPrefixes, err
+		}
+		latency.RecordSince(start)
+
+		pages++
+		items += uint64(len(out.Contents) + len(out.CommonPrefixes))
+		for _, cp := range out.CommonPrefixes {
+			commonPrefixes = append(commonPrefixes, aws.StringValue(cp.Prefix))
+		}
+
+		if !aws.BoolValue(out.IsTruncated) {
+			return pages, items, commonPrefixes, nil
+		}
+		input.ContinuationToken = out.NextContinuationToken
+	}
+}
+
+// ListTest measures ListObjectsV2 performance. It populates keyCount empty
+// objects spread across fanout sub-prefixes, then for each max-keys value
+// lists them both flat and hierarchically (by delimiter, one sub-prefix at a
+// time), reporting pages/sec, keys/sec and per-page latency. The objects are
+// deleted afterwards.
+func (s *S3Tester) ListTest(keyCount int, fanout int, maxKeysList []int) []OperationResult {
+
+	var results []OperationResult
+
+	fmt.Printf("Populating %d keys across %d prefixes for S3 LIST test.\n", keyCount, fanout)
+	put := s.runKeyOps("LIST-POPULATE", keyCount, func(svc *s3.S3, i int) error {
+		_, err := svc.PutObject(&s3.PutObjectInput{
+			Bucket: &s.bucket,
+			Key:    aws.String(generateListObjectName(s.uniqueId, fanout, i)),
+		})
+		return err
+	})
+	results = append(results, put)
+
+	svc := s3.New(s.newSession())
+	root := generateListPrefix(s.uniqueId)
+
+	for _, maxKeys := range maxKeysList {
+
+		name := fmt.Sprintf("LIST max-keys=%d flat", maxKeys)
+		latency := newLatencyHistogram()
+		atomic.StoreUint64(&s.atm_connections, 0)
+		start := time.Now()
+		pages, items, _, err := s.listPages(svc, root, "", maxKeys, latency)
+		elapsed := time.Since(start)
+		if err != nil {
+			fmt.Printf("S3 %s failed: %v\n", name, err)
+		}
+		list := newListResult(name, pages, items, err, latency, elapsed)
+		list.ConnectionsOpened = atomic.LoadUint64(&s.atm_connections)
+		results = append(results, list)
+
+		name = fmt.Sprintf("LIST max-keys=%d delimited", maxKeys)
+		latency = newLatencyHistogram()
+		atomic.StoreUint64(&s.atm_connections, 0)
+		start = time.Now()
+		pages, items, prefixes, err := s.listPages(svc, root, "/", maxKeys, latency)
+		for _, p := range prefixes {
+			if err != nil {
+				break
+			}
+			var subPages, subItems uint64
+			subPages, subItems, _, err = s.listPages(svc, p, "/", maxKeys, latency)
+			pages += subPages
+			items += subItems
+		}
+		elapsed = time.Since(start)
+		if err != nil {
+			fmt.Printf("S3 %s failed: %v\n", name, err)
+		}
+		list = newListResult(name, pages, items, err, latency, elapsed)
+		list.ConnectionsOpened = atomic.LoadUint64(&s.atm_connections)
+		results = append(results, list)
+	}
+
+	fmt.Println("Deleting S3 LIST test keys.")
+	iter := s3manager.NewDeleteListIterator(svc, &s3.ListObjectsInput{
+		Bucket: &s.bucket,
+		Prefix: aws.String(root),
+	})
+	err := s3manager.NewBatchDeleteWithClient(svc).Delete(aws.BackgroundContext(), iter)
+	if err != nil {
+		fmt.Println("failed to delete S3 LIST test keys", err)
+	}
+
+	return results
+}
+
+// newListResult reports a listing pass, where each page is one operation and
+// the keys and prefixes returned are the items.
+func newListResult(name string, pages uint64, items uint64, err error, latency *latencyHistogram, elapsed time.Duration) OperationResult {
+	failed := uint64(0)
+	if err != nil {
+		failed = 1
+	}
+	r := newOperationResult(name, pages, failed, latency, elapsed)
+	r.Items = items
+	r.ItemsPerSec = float64(items) / elapsed.Seconds()
+	return r
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+func (s *S3Tester) mixedWorker(readPercent int, c *mixedCounters) {
+
+	defer s.wg.Done()
+
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	src := make([]byte, testObjectSize)
+	rng.Read(src)
+
+	sess := s.newSession()
+	uploader := s3manager.NewUploader(sess)
+	downloader := s3manager.NewDownloader(sess)
+	w := newMixedCounters()
+
+	for atomic.LoadInt32(&s.atm_finished) == 0 {
+		key := generateTestObjectName(s.uniqueId, rng.Intn(s.objectsWritten)+1)
+
+		if rng.Intn(100) < readPercent {
+			sink := newCountingSink()
+			start := time.Now()
+			_, err := downloader.Download(sink, &s3.GetObjectInput{Bucket: &s.bucket, Key: &key})
+			if err != nil {
+				if w.failedReads == 0 {
+					printS3Error("failed to download object", err)
+				}
+				w.failedReads++
+				continue
+			}
+			w.readLatency.RecordSince(start)
+			w.bytesRead += sink.Bytes()
+			continue
+		}
+
+		counter := &transferCounter{}
+		start := time.Now()
+		_, err := uploader.UploadWithContext(withTransferCounter(context.Background(), counter), &s3manager.UploadInput{
+			Bucket: &s.bucket,
+			Key:    &key,
+			Body:   bytes.NewReader(src),
+		})
+		w.failedWriteBytes += counter.FailedBytes()
+		if err != nil {
+			if w.failedWrites == 0 {
+				printS3Error("failed to upload object", err)
+			}
+			w.failedWrites++
+			w.failedWriteBytes += counter.Bytes()
+			continue
+		}
+		w.writeLatency.RecordSince(start)
+		w.bytesWritten += counter.Bytes()
+	}
+	c.merge(w)
+}
+
+// MixedTest downloads and overwrites whole objects written by the write test,
+// each worker picking objects at random from all of them, with readPercent of
+// requests being downloads. Downloads and uploads are reported as separate
+// phases.
+func (s *S3Tester) MixedTest(readPercent int) MixedResult {
+
+	if s.objectsWritten == 0 {
+		fmt.Println("[error] Unable to perform S3 MixedTest, no objects written.")
+		return MixedResult{ReadPercent: readPercent}
+	}
+
+	counters := newMixedCounters()
+	atomic.StoreInt32(&s.atm_finished, 0)
+	atomic.StoreUint64(&s.atm_connections, 0)
+	s.timings.Reset()
+	for i := 1; i <= s.concurrency; i++ {
+		s.wg.Add(1)
+		go s.mixedWorker(readPercent, counters)
+	}
+	start := time.Now()
+	time.Sleep(time.Duration(s.durationSeconds) * time.Second)
+	atomic.StoreInt32(&s.atm_finished, 1)
+	s.wg.Wait()
+
+	result := counters.result(readPercent, time.Since(start))
+	result.ConnectionsOpened = atomic.LoadUint64(&s.atm_connections)
+	result.Timing = s.timings.Summary()
+	return result
+}
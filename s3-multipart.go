@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// S3 limits on multipart uploads.
+const minPartSize = 5 * 1024 * 1024
+const maxPartSize = 5 * 1024 * 1024 * 1024
+const maxParts = 10000
+
+func generateMultipartObjectName(prefix string, i int) string {
+	return "multipart-" + prefix + "-" + strconv.Itoa(i)
+}
+
+// multipartCounters accumulates part uploads across all objects.
+type multipartCounters struct {
+	mu              sync.Mutex
+	partLatency     *latencyHistogram
+	completeLatency *latencyHistogram
+	bytes           uint64
+	parts           uint64
+	failedParts     uint64
+	failedBytes     uint64
+	completes       uint64
+	failedCompletes uint64
+}
+
+// uploadMultipart uploads one object of objectSize bytes from src, with up to
+// parallelism parts in flight, and completes the upload, or aborts it if any
+// part fails.
+func (s *S3Tester) uploadMultipart(svc *s3.S3, key string, src []byte, objectSize uint64, partSize uint64, parallelism int, c *multipartCounters) {
+
+	create, err := svc.CreateMultipartUpload(&s3.CreateMultipartUploadInput{Bucket: &s.bucket, Key: &key})
+	if err != nil {
+		printS3Error("failed to create multipart upload", err)
+		c.mu.Lock()
+		c.failedCompletes++
+		c.mu.Unlock()
+		return
+	}
+
+	partCount := int((objectSize + partSize - 1) / partSize)
+	parts := make([]*s3.CompletedPart, 0, partCount)
+	failed := false
+	var partsMu sync.Mutex
+
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < parallelism; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h := newLatencyHistogram()
+			done, failedParts, sent, failedBytes := uint64(0), uint64(0), uint64(0), uint64(0)
+
+			for p := range next {
+				size := partSize
+				if remaining := objectSize - uint64(p)*partSize; remaining < size {
+					size = remaining
+				}
+				number := int64(p + 1)
+
+				counter := &transferCounter{}
+				start := time.Now()
+				out, err := svc.UploadPartWithContext(withTransferCounter(context.Background(), counter), &s3.UploadPartInput{
+					Bucket:     &s.bucket,
+					Key:        &key,
+					UploadId:   create.UploadId,
+					PartNumber: &number,
+					Body:       bytes.NewReader(src[:size]),
+				})
+				failedBytes += counter.FailedBytes()
+				if err != nil {
+					if failedParts == 0 {
+						printS3Error(fmt.Sprintf("failed to upload part %d of %s", number, key), err)
+					}
+					failedParts++
+					failedBytes += counter.Bytes()
+					partsMu.Lock()
+					failed = true
+					partsMu.Unlock()
+					continue
+				}
+				h.RecordSince(start)
+				done++
+				sent += counter.Bytes()
+
+				partsMu.Lock()
+				parts = append(parts, &s3.CompletedPart{ETag: out.ETag, PartNumber: aws.Int64(number)})
+				partsMu.Unlock()
+			}
+
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.partLatency.Merge(h)
+			c.parts += done
+			c.failedParts += failedParts
+			c.bytes += sent
+			c.failedBytes += failedBytes
+		}()
+	}
+	for p := 0; p < partCount; p++ {
+		next <- p
+	}
+	close(next)
+	wg.Wait()
+
+	if failed {
+		svc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{Bucket: &s.bucket, Key: &key, UploadId: create.UploadId})
+		c.mu.Lock()
+		c.failedCompletes++
+		c.mu.Unlock()
+		return
+	}
+
+	sort.Slice(parts, func(i, j int) bool { return *parts[i].PartNumber < *parts[j].PartNumber })
+	start := time.Now()
+	_, err = svc.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          &s.bucket,
+		Key:             &key,
+		UploadId:        create.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		printS3Error("failed to complete multipart upload", err)
+		c.failedCompletes++
+		return
+	}
+	c.completeLatency.RecordSince(start)
+	c.completes++
+}
+
+// MultipartTest uploads objectCount objects of objectSize bytes at once, each
+// with explicit CreateMultipartUpload, UploadPart and CompleteMultipartUpload
+// calls, keeping up to parallelism parts of partSize bytes in flight per
+// object. It reports the upload throughput, per-part latency and complete
+// latency, and deletes the objects afterwards.
+func (s *S3Tester) MultipartTest(objectSize uint64, partSize uint64, parallelism int, objectCount int) (PhaseResult, []OperationResult) {
+
+	src := make([]byte, partSize)
+	rand.Read(src)
+
+	c := &multipartCounters{partLatency: newLatencyHistogram(), completeLatency: newLatencyHistogram()}
+	svc := s3.New(s.newSession())
+	atomic.StoreUint64(&s.atm_connections, 0)
+	s.timings.Reset()
+
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 1; i <= objectCount; i++ {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			s.uploadMultipart(svc, key, src, objectSize, partSize, parallelism, c)
+		}(generateMultipartObjectName(s.uniqueId, i))
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	phase := newPhaseResultElapsed(c.bytes, c.failedParts, c.failedBytes, c.partLatency, elapsed)
+	phase.ConnectionsOpened = atomic.LoadUint64(&s.atm_connections)
+	phase.Timing = s.timings.Summary()
+
+	label := fmt.Sprintf("part=%dMiB", partSize/(1024*1024))
+	ops := []OperationResult{
+		newOperationResult("MULTIPART UPLOAD-PART "+label, c.parts, c.failedParts, c.partLatency, elapsed),
+		newOperationResult("MULTIPART COMPLETE "+label, c.completes, c.failedCompletes, c.completeLatency, elapsed),
+	}
+	for i := range ops {
+		ops[i].ConnectionsOpened = phase.ConnectionsOpened
+	}
+
+	keylist := make([]*s3.ObjectIdentifier, 0, objectCount)
+	for i := 1; i <= objectCount; i++ {
+		keylist = append(keylist, &s3.ObjectIdentifier{Key: aws.String(generateMultipartObjectName(s.uniqueId, i))})
+	}
+	_, err := svc.DeleteObjects(&s3.DeleteObjectsInput{Bucket: &s.bucket, Delete: &s3.Delete{Objects: keylist}})
+	if err != nil {
+		printS3Error("failed to delete multipart test objects", err)
+	}
+
+	return phase, ops
+}
+
+// testKeyPrefixes returns the start of every key this client's S3 tests
+// create, so that keys of other clients sharing the bucket are left alone.
+func (s *S3Tester) testKeyPrefixes() []string {
+	return []string{
+		"objname-" + s.uniqueId + "-",
+		"smallobj-" + s.uniqueId + "-",
+		generateListPrefix(s.uniqueId),
+		"multipart-" + s.uniqueId + "-",
+	}
+}
+
+// abortIncompleteUploads aborts multipart uploads of this client's test keys
+// that were never completed, such as those left behind by interrupted runs,
+// and returns the number aborted. Uploads of other keys in the bucket are
+// left alone.
+func (s *S3Tester) abortIncompleteUploads(svc *s3.S3) (int, error) {
+	aborted := 0
+	for _, prefix := range s.testKeyPrefixes() {
+		var uploads []*s3.MultipartUpload
+		err := svc.ListMultipartUploadsPages(&s3.ListMultipartUploadsInput{
+			Bucket: &s.bucket,
+			Prefix: aws.String(prefix),
+		}, func(p *s3.ListMultipartUploadsOutput, _ bool) bool {
+			uploads = append(uploads, p.Uploads...)
+			return true
+		})
+		if err != nil {
+			return aborted, err
+		}
+
+		for _, u := range uploads {
+			_, err := svc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{Bucket: &s.bucket, Key: u.Key, UploadId: u.UploadId})
+			if err != nil {
+				return aborted, err
+			}
+			aborted++
+		}
+	}
+	return aborted, nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func generateSmallObjectName(prefix string, i int) string {
+	return "smallobj-" + prefix + "-" + strconv.Itoa(i)
+}
+
+// runKeyOps calls op once for every key index in [0, keyCount), spreading the
+// keys across the tester's workers, and reports the resulting operation rate.
+func (s *S3Tester) runKeyOps(name string, keyCount int, op func(svc *s3.S3, i int) error) OperationResult {
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	latency := newLatencyHistogram()
+	ops := uint64(0)
+	failed_ops := uint64(0)
+	atomic.StoreUint64(&s.atm_connections, 0)
+
+	start := time.Now()
+	for w := 0; w < s.concurrency; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			svc := s3.New(s.newSession())
+			h := newLatencyHistogram()
+			done, failed := uint64(0), uint64(0)
+
+			for i := w; i < keyCount; i += s.concurrency {
+				opStart := time.Now()
+				err := op(svc, i)
+				if err != nil {
+					if failed == 0 {
+						printS3Error(fmt.Sprintf("S3 %s failed:", name), err)
+					}
+					failed++
+					continue
+				}
+				h.RecordSince(opStart)
+				done++
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			latency.Merge(h)
+			ops += done
+			failed_ops += failed
+		}(w)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	result := newOperationResult(name, ops, failed_ops, latency, elapsed)
+	result.ConnectionsOpened = atomic.LoadUint64(&s.atm_connections)
+	return result
+}
+
+// SmallObjectTest measures operations per second for many small objects by
+// running PUT, GET, HEAD and DELETE once against each of keyCount keys. Object
+// sizes are taken round-robin from sizes, in bytes.
+func (s *S3Tester) SmallObjectTest(keyCount int, sizes []int) []OperationResult {
+
+	maxSize := 0
+	for _, sz := range sizes {
+		if sz > maxSize {
+			maxSize = sz
+		}
+	}
+	src := make([]byte, maxSize)
+	rand.Read(src)
+
+	var results []OperationResult
+
+	put := s.runKeyOps("PUT", keyCount, func(svc *s3.S3, i int) error {
+		_, err := svc.PutObject(&s3.PutObjectInput{
+			Bucket: &s.bucket,
+			Key:    aws.String(generateSmallObjectName(s.uniqueId, i)),
+			Body:   bytes.NewReader(src[:sizes[i%len(sizes)]]),
+		})
+		return err
+	})
+	results = append(results, put)
+
+	get := s.runKeyOps("GET", keyCount, func(svc *s3.S3, i int) error {
+		out, err := svc.GetObject(&s3.GetObjectInput{
+			Bucket: &s.bucket,
+			Key:    aws.String(generateSmallObjectName(s.uniqueId, i)),
+		})
+		if err != nil {
+			return err
+		}
+		defer out.Body.Close()
+		_, err = io.Copy(newCountingSink(), out.Body)
+		return err
+	})
+	results = append(results, get)
+
+	head := s.runKeyOps("HEAD", keyCount, func(svc *s3.S3, i int) error {
+		_, err := svc.HeadObject(&s3.HeadObjectInput{
+			Bucket: &s.bucket,
+			Key:    aws.String(generateSmallObjectName(s.uniqueId, i)),
+		})
+		return err
+	})
+	results = append(results, head)
+
+	del := s.runKeyOps("DELETE", keyCount, func(svc *s3.S3, i int) error {
+		_, err := svc.DeleteObject(&s3.DeleteObjectInput{
+			Bucket: &s.bucket,
+			Key:    aws.String(generateSmallObjectName(s.uniqueId, i)),
+		})
+		return err
+	})
+	results = append(results, del)
+
+	return results
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Offset patterns for the ranged read test.
+const (
+	rangePatternRandom  = "random"
+	rangePatternStrided = "strided"
+)
+
+type rangedReadCounters struct {
+	mu          sync.Mutex
+	latency     *latencyHistogram
+	ttfb        *latencyHistogram
+	bytes       uint64
+	requests    uint64
+	failed      uint64
+	failedBytes uint64
+}
+
+// rangedReadWorker reads rangeSize byte ranges of the written objects until
+// the test finishes. With the random pattern each request picks a random
+// object and range-aligned offset. With the strided pattern worker w starts at
+// the beginning of object w and steps stride bytes between requests, moving
+// on to the next object at the end of each one.
+func (s *S3Tester) rangedReadWorker(w int, rangeSize int64, stride int64, pattern string, c *rangedReadCounters) {
+
+	defer s.wg.Done()
+
+	svc := s3.New(s.newSession())
+	rng := rand.New(rand.NewSource(time.Now().UnixNano() + int64(w)))
+	buf := make([]byte, rangeSize)
+
+	latency, ttfb := newLatencyHistogram(), newLatencyHistogram()
+	bytes_read, requests, failed, failed_bytes := uint64(0), uint64(0), uint64(0), uint64(0)
+
+	object := w % s.objectsWritten
+	offset := int64(0)
+	for atomic.LoadInt32(&s.atm_finished) == 0 {
+		if pattern == rangePatternRandom {
+			object = rng.Intn(s.objectsWritten)
+			offset = rng.Int63n(testObjectSize/rangeSize) * rangeSize
+		} else if offset+rangeSize > testObjectSize {
+			object = (object + 1) % s.objectsWritten
+			offset = 0
+		}
+		key := generateTestObjectName(s.uniqueId, object+1)
+
+		// The response headers arriving mark the time to first byte, as in
+		// the request timing breakdown.
+		start := time.Now()
+		var firstByte time.Duration
+		ctx := httptrace.WithClientTrace(aws.BackgroundContext(), &httptrace.ClientTrace{
+			GotFirstResponseByte: func() { firstByte = time.Since(start) },
+		})
+		out, err := svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+			Bucket: &s.bucket,
+			Key:    &key,
+			Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+rangeSize-1)),
+		})
+		count := 0
+		if err == nil {
+			count, err = io.ReadFull(out.Body, buf)
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				err = nil
+			}
+			out.Body.Close()
+		}
+		if err == nil && count != len(buf) {
+			err = fmt.Errorf("short range read of %d bytes", count)
+		}
+		if err != nil {
+			if failed == 0 {
+				printS3Error("failed ranged read", err)
+			}
+			failed++
+			failed_bytes += uint64(count)
+		} else {
+			latency.RecordSince(start)
+			ttfb.Record(firstByte)
+			requests++
+			bytes_read += uint64(count)
+		}
+
+		offset += stride
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.latency.Merge(latency)
+	c.ttfb.Merge(ttfb)
+	c.bytes += bytes_read
+	c.requests += requests
+	c.failed += failed
+	c.failedBytes += failed_bytes
+}
+
+// RangedReadTest issues GETs of rangeSize byte ranges of the objects written
+// by WriteTest for the test duration, as readers of columnar formats do. It
+// reports throughput, and requests per second with latency and time to first
+// byte.
+func (s *S3Tester) RangedReadTest(rangeSize int64, stride int64, pattern string) (PhaseResult, OperationResult) {
+
+	if s.objectsWritten == 0 {
+		fmt.Println("[error] Unable to perform S3 RangedReadTest, no objects written.")
+		return PhaseResult{}, OperationResult{}
+	}
+
+	c := &rangedReadCounters{latency: newLatencyHistogram(), ttfb: newLatencyHistogram()}
+	atomic.StoreInt32(&s.atm_finished, 0)
+	atomic.StoreUint64(&s.atm_connections, 0)
+	s.timings.Reset()
+	for w := 0; w < s.concurrency; w++ {
+		s.wg.Add(1)
+		go s.rangedReadWorker(w, rangeSize, stride, pattern, c)
+	}
+
+	time.Sleep(time.Duration(s.durationSeconds) * time.Second)
+	atomic.StoreInt32(&s.atm_finished, 1)
+	s.wg.Wait()
+
+	phase := newPhaseResult(c.bytes, c.failed, c.failedBytes, c.latency, s.durationSeconds)
+	phase.ConnectionsOpened = atomic.LoadUint64(&s.atm_connections)
+	phase.Timing = s.timings.Summary()
+
+	name := fmt.Sprintf("RANGED GET %s size=%dKiB", strings.ToUpper(pattern), rangeSize/1024)
+	op := newOperationResult(name, c.requests, c.failed, c.latency, time.Duration(s.durationSeconds)*time.Second)
+	ttfb := c.ttfb.Summary()
+	op.TTFB = &ttfb
+	return phase, op
+}
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testS3Server is a memory-backed S3 server for tests, listening on a
+// loopback port. It takes path-style requests signed with SigV4 for one
+// access key, and supports the calls S3Tester makes: object PUT, GET (with
+// ranges), HEAD and DELETE, multipart uploads, DeleteObjects, and paged
+// ListObjects and ListObjectsV2.
+type testS3Server struct {
+	srv *httptest.Server
+
+	accessKey string
+	secretKey string
+	region    string
+
+	mu      sync.Mutex
+	buckets map[string]map[string][]byte
+	uploads map[string]*testUpload
+	nextId  int
+
+	// requests counts the requests handled, by operation, and ackedBytes
+	// the body bytes of those that succeeded.
+	requests   map[string]int
+	ackedBytes uint64
+
+	// Faults: requests for failOp, or any operation if it is "*", fail
+	// with a 500 after their body is read, failCount more times or always
+	// if it is negative. delay holds back every response.
+	failOp    string
+	failCount int
+	delay     time.Duration
+}
+
+// testUpload is an incomplete multipart upload.
+type testUpload struct {
+	bucket string
+	key    string
+	parts  map[int][]byte
+}
+
+// s3Error is a failed request's S3 error code and HTTP status.
+type s3Error struct {
+	status int
+	code   string
+}
+
+// startTestS3Server starts a server holding the given empty buckets, and
+// stops it when the test ends.
+func startTestS3Server(t *testing.T, buckets ...string) *testS3Server {
+	t.Helper()
+	s := &testS3Server{
+		accessKey: "AKIDTESTS3SERVER",
+		secretKey: "test-secret-key",
+		region:    "us-east-1",
+		buckets:   make(map[string]map[string][]byte),
+		uploads:   make(map[string]*testUpload),
+		requests:  make(map[string]int),
+	}
+	for _, b := range buckets {
+		s.buckets[b] = make(map[string][]byte)
+	}
+	s.srv = httptest.NewServer(http.HandlerFunc(s.handle))
+	t.Cleanup(s.srv.Close)
+	return s
+}
+
+// hostPort returns the host and port to give S3Tester.
+func (s *testS3Server) hostPort(t *testing.T) (string, int) {
+	host, port, err := net.SplitHostPort(s.srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return host, p
+}
+
+// set changes the server's settings or contents under its lock.
+func (s *testS3Server) set(f func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f()
+}
+
+// requestCount returns the number of requests handled of operation op.
+func (s *testS3Server) requestCount(op string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[op]
+}
+
+// keys returns the sorted keys of a bucket.
+func (s *testS3Server) keys(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for k := range s.buckets[bucket] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// uploadCount returns the number of incomplete multipart uploads.
+func (s *testS3Server) uploadCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.uploads)
+}
+
+func (s *testS3Server) handle(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	delay := s.delay
+	s.mu.Unlock()
+	time.Sleep(delay)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bucket, key := r.URL.Path, ""
+	if i := strings.Index(bucket[1:], "/"); i >= 0 {
+		bucket, key = bucket[1:i+1], bucket[i+2:]
+	} else {
+		bucket = bucket[1:]
+	}
+	op := s3Operation(r, bucket, key)
+	s.requests[op]++
+
+	if serr := s.verifySignature(r, body); serr != nil {
+		writeS3Error(w, serr)
+		return
+	}
+	if s.failCount != 0 && (s.failOp == op || s.failOp == "*") {
+		if s.failCount > 0 {
+			s.failCount--
+		}
+		writeS3Error(w, &s3Error{http.StatusInternalServerError, "InternalError"})
+		return
+	}
+
+	objects, ok := s.buckets[bucket]
+	if bucket != "" && !ok {
+		writeS3Error(w, &s3Error{http.StatusNotFound, "NoSuchBucket"})
+		return
+	}
+	if serr := s.serveOperation(w, r, op, objects, bucket, key, body); serr != nil {
+		writeS3Error(w, serr)
+		return
+	}
+	s.ackedBytes += uint64(len(body))
+}
+
+// s3Operation names the S3 call a request makes.
+func s3Operation(r *http.Request, bucket string, key string) string {
+	q := r.URL.Query()
+	_, uploads := q["uploads"]
+	_, uploadId := q["uploadId"]
+	_, del := q["delete"]
+	switch {
+	case bucket == "":
+		return "ListBuckets"
+	case key == "" && r.Method == "GET" && uploads:
+		return "ListMultipartUploads"
+	case key == "" && r.Method == "GET" && q.Get("list-type") == "2":
+		return "ListObjectsV2"
+	case key == "" && r.Method == "GET":
+		return "ListObjects"
+	case key == "" && r.Method == "POST" && del:
+		return "DeleteObjects"
+	case key == "":
+		return "UnsupportedBucket" + r.Method
+	case r.Method == "POST" && uploads:
+		return "CreateMultipartUpload"
+	case r.Method == "POST" && uploadId:
+		return "CompleteMultipartUpload"
+	case r.Method == "PUT" && uploadId:
+		return "UploadPart"
+	case r.Method == "DELETE" && uploadId:
+		return "AbortMultipartUpload"
+	case r.Method == "PUT":
+		return "PutObject"
+	case r.Method == "GET":
+		return "GetObject"
+	case r.Method == "HEAD":
+		return "HeadObject"
+	case r.Method == "DELETE":
+		return "DeleteObject"
+	}
+	return "UnsupportedObject" + r.Method
+}
+
+func (s *testS3Server) serveOperation(w http.ResponseWriter, r *http.Request, op string, objects map[string][]byte, bucket string, key string, body []byte) *s3Error {
+	q := r.URL.Query()
+	switch op {
+	case "ListBuckets":
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"ListAllMyBucketsResult"`
+		}{})
+
+	case "ListObjects", "ListObjectsV2":
+		return s.listObjects(w, op, objects, bucket, q.Get)
+
+	case "ListMultipartUploads":
+		type upload struct {
+			Key      string
+			UploadId string
+		}
+		res := struct {
+			XMLName     xml.Name `xml:"ListMultipartUploadsResult"`
+			Bucket      string
+			IsTruncated bool
+			Upload      []upload
+		}{Bucket: bucket}
+		for id, u := range s.uploads {
+			if u.bucket == bucket && strings.HasPrefix(u.key, q.Get("prefix")) {
+				res.Upload = append(res.Upload, upload{u.key, id})
+			}
+		}
+		writeXML(w, res)
+
+	case "DeleteObjects":
+		var req struct {
+			Object []struct{ Key string }
+		}
+		if err := xml.Unmarshal(body, &req); err != nil || len(req.Object) == 0 {
+			return &s3Error{http.StatusBadRequest, "MalformedXML"}
+		}
+		type deleted struct{ Key string }
+		res := struct {
+			XMLName xml.Name `xml:"DeleteResult"`
+			Deleted []deleted
+		}{}
+		for _, o := range req.Object {
+			delete(objects, o.Key)
+			res.Deleted = append(res.Deleted, deleted{o.Key})
+		}
+		writeXML(w, res)
+
+	case "PutObject":
+		objects[key] = body
+		w.Header().Set("ETag", etag(body))
+
+	case "GetObject", "HeadObject":
+		data, ok := objects[key]
+		if !ok {
+			return &s3Error{http.StatusNotFound, "NoSuchKey"}
+		}
+		w.Header().Set("ETag", etag(data))
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+
+	case "DeleteObject":
+		delete(objects, key)
+		w.WriteHeader(http.StatusNoContent)
+
+	case "CreateMultipartUpload":
+		s.nextId++
+		id := "upload-" + strconv.Itoa(s.nextId)
+		s.uploads[id] = &testUpload{bucket: bucket, key: key, parts: make(map[int][]byte)}
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: bucket, Key: key, UploadId: id})
+
+	case "UploadPart":
+		u, ok := s.uploads[q.Get("uploadId")]
+		if !ok {
+			return &s3Error{http.StatusNotFound, "NoSuchUpload"}
+		}
+		number, err := strconv.Atoi(q.Get("partNumber"))
+		if err != nil || number < 1 {
+			return &s3Error{http.StatusBadRequest, "InvalidArgument"}
+		}
+		u.parts[number] = body
+		w.Header().Set("ETag", etag(body))
+
+	case "CompleteMultipartUpload":
+		id := q.Get("uploadId")
+		u, ok := s.uploads[id]
+		if !ok {
+			return &s3Error{http.StatusNotFound, "NoSuchUpload"}
+		}
+		var req struct {
+			Part []struct {
+				PartNumber int
+				ETag       string
+			}
+		}
+		if err := xml.Unmarshal(body, &req); err != nil || len(req.Part) == 0 {
+			return &s3Error{http.StatusBadRequest, "MalformedXML"}
+		}
+		var data []byte
+		for i, p := range req.Part {
+			part, ok := u.parts[p.PartNumber]
+			if !ok || p.ETag != etag(part) {
+				return &s3Error{http.StatusBadRequest, "InvalidPart"}
+			}
+			if i > 0 && p.PartNumber <= req.Part[i-1].PartNumber {
+				return &s3Error{http.StatusBadRequest, "InvalidPartOrder"}
+			}
+			data = append(data, part...)
+		}
+		objects[key] = data
+		delete(s.uploads, id)
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Bucket  string
+			Key     string
+			ETag    string
+		}{Bucket: bucket, Key: key, ETag: etag(data)})
+
+	case "AbortMultipartUpload":
+		if _, ok := s.uploads[q.Get("uploadId")]; !ok {
+			return &s3Error{http.StatusNotFound, "NoSuchUpload"}
+		}
+		delete(s.uploads, q.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		return &s3Error{http.StatusNotImplemented, "NotImplemented"}
+	}
+	return nil
+}
+
+// listObjects answers ListObjects and ListObjectsV2, returning up to max-keys
+// keys and common prefixes after the marker or continuation token.
+func (s *testS3Server) listObjects(w http.ResponseWriter, op string, objects map[string][]byte, bucket string, param func(string) string) *s3Error {
+	prefix, delimiter := param("prefix"), param("delimiter")
+	maxKeys := 1000
+	if v := param("max-keys"); v != "" {
+		var err error
+		if maxKeys, err = strconv.Atoi(v); err != nil || maxKeys < 1 || maxKeys > 1000 {
+			maxKeys = 1000
+		}
+	}
+	after := param("marker")
+	if op == "ListObjectsV2" {
+		after = param("continuation-token")
+	}
+
+	var keys []string
+	for k := range objects {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	type content struct {
+		Key  string
+		Size int
+		ETag string
+	}
+	type commonPrefix struct{ Prefix string }
+	var contents []content
+	var prefixes []commonPrefix
+	truncated, last := false, ""
+	for _, k := range keys {
+		if k <= after {
+			continue
+		}
+		item, isPrefix := k, false
+		if delimiter != "" {
+			if i := strings.Index(k[len(prefix):], delimiter); i >= 0 {
+				item, isPrefix = k[:len(prefix)+i+len(delimiter)], true
+				if item <= after || (len(prefixes) > 0 && prefixes[len(prefixes)-1].Prefix == item) {
+					continue
+				}
+			}
+		}
+		if len(contents)+len(prefixes) == maxKeys {
+			truncated = true
+			break
+		}
+		if isPrefix {
+			prefixes = append(prefixes, commonPrefix{item})
+		} else {
+			contents = append(contents, content{k, len(objects[k]), etag(objects[k])})
+		}
+		last = item
+	}
+	if !truncated {
+		last = ""
+	}
+
+	res := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Name                  string
+		Prefix                string
+		MaxKeys               int
+		IsTruncated           bool
+		NextMarker            string `xml:",omitempty"`
+		NextContinuationToken string `xml:",omitempty"`
+		KeyCount              int    `xml:",omitempty"`
+		Contents              []content
+		CommonPrefixes        []commonPrefix
+	}{Name: bucket, Prefix: prefix, MaxKeys: maxKeys, IsTruncated: truncated, Contents: contents, CommonPrefixes: prefixes}
+	if op == "ListObjectsV2" {
+		res.NextContinuationToken = last
+		res.KeyCount = len(contents) + len(prefixes)
+	} else {
+		res.NextMarker = last
+	}
+	writeXML(w, res)
+	return nil
+}
+
+// verifySignature checks a request's SigV4 Authorization header and signed
+// payload hash against the server's key.
+func (s *testS3Server) verifySignature(r *http.Request, body []byte) *s3Error {
+	denied := &s3Error{http.StatusForbidden, "AccessDenied"}
+	auth := strings.TrimPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ")
+	if auth == r.Header.Get("Authorization") {
+		return denied
+	}
+	fields := make(map[string]string)
+	for _, f := range strings.Split(auth, ",") {
+		kv := strings.SplitN(strings.TrimSpace(f), "=", 2)
+		if len(kv) == 2 {
+			fields[kv[0]] = kv[1]
+		}
+	}
+	credential := strings.Split(fields["Credential"], "/")
+	if len(credential) != 5 || credential[2] != s.region || credential[3] != "s3" || credential[4] != "aws4_request" {
+		return denied
+	}
+	if credential[0] != s.accessKey {
+		return &s3Error{http.StatusForbidden, "InvalidAccessKeyId"}
+	}
+	signed, err := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date"))
+	if err != nil || signed.Format("20060102") != credential[1] {
+		return denied
+	}
+	if absDuration(time.Since(signed)) > s3SignatureTolerance {
+		return &s3Error{http.StatusForbidden, "RequestTimeTooSkewed"}
+	}
+
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash != "UNSIGNED-PAYLOAD" {
+		sum := sha256.Sum256(body)
+		if payloadHash != hex.EncodeToString(sum[:]) {
+			return &s3Error{http.StatusBadRequest, "XAmzContentSHA256Mismatch"}
+		}
+	}
+
+	var headers []string
+	for _, name := range strings.Split(fields["SignedHeaders"], ";") {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		headers = append(headers, name+":"+strings.Join(strings.Fields(value), " "))
+	}
+	canonical := strings.Join([]string{
+		r.Method,
+		r.URL.EscapedPath(),
+		strings.Replace(r.URL.Query().Encode(), "+", "%20", -1),
+		strings.Join(headers, "\n") + "\n",
+		fields["SignedHeaders"],
+		payloadHash,
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonical))
+	scope := strings.Join(credential[1:], "/")
+	toSign := "AWS4-HMAC-SHA256\n" + r.Header.Get("X-Amz-Date") + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := []byte("AWS4" + s.secretKey)
+	for _, part := range credential[1:] {
+		key = hmacSHA256(key, part)
+	}
+	if !hmac.Equal([]byte(hex.EncodeToString(hmacSHA256(key, toSign))), []byte(fields["Signature"])) {
+		return &s3Error{http.StatusForbidden, "SignatureDoesNotMatch"}
+	}
+	return nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) {
+	out, err := xml.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write([]byte(xml.Header))
+	w.Write(out)
+}
+
+func writeS3Error(w http.ResponseWriter, e *s3Error) {
+	out, _ := xml.Marshal(struct {
+		XMLName   xml.Name `xml:"Error"`
+		Code      string
+		Message   string
+		RequestId string
+	}{Code: e.code, Message: e.code, RequestId: "test"})
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(e.status)
+	w.Write([]byte(xml.Header))
+	w.Write(out)
+}
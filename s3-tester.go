@@ -2,20 +2,71 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"fmt"
+	"io"
 	"math/rand"
+	"net"
+	"net/http"
+	"os"
 	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
 
+// S3Options holds optional S3Tester settings. The zero value gives the
+// default behavior.
+type S3Options struct {
+	// Verify writes self-describing blocks derived from Seed and checks
+	// every block read back.
+	Verify bool
+	Seed   uint64
+
+	// SourceIP, if set, is the local address all connections originate from.
+	SourceIP string
+
+	// HTTP connection tuning. MaxConnsPerHost of zero is unlimited and an
+	// IdleTimeout of zero keeps the net/http default.
+	MaxConnsPerHost   int
+	IdleTimeout       time.Duration
+	SocketBuffer      int
+	DisableKeepAlives bool
+
+	// Endpoint addressing. UseTLS connects with HTTPS, verified against the
+	// system roots plus CABundle unless InsecureSkipVerify is set. A Port of
+	// zero uses the scheme's default port, and an empty Region is us-east-1.
+	UseTLS             bool
+	CABundle           string
+	InsecureSkipVerify bool
+	VirtualHosted      bool
+	Region             string
+	Port               int
+
+	// Without keys, credentials are read from Profile in CredentialsFile
+	// if either is set, or otherwise found by the AWS SDK's default chain.
+	Profile         string
+	CredentialsFile string
+
+	// MaxClockSkew is the largest difference from the endpoint's clock that
+	// is accepted before testing. Zero uses the SigV4 tolerance.
+	MaxClockSkew time.Duration
+}
+
+// s3ProtocolName names the protocol in results, distinguishing HTTPS.
+func s3ProtocolName(useTLS bool) string {
+	if useTLS {
+		return "s3-https"
+	}
+	return "s3"
+}
+
 type S3Tester struct {
 	endpoint        string
 	accessKey       string
@@ -24,31 +75,96 @@ type S3Tester struct {
 	concurrency     int
 	durationSeconds int
 	uniqueId        string
+	opts            S3Options
+	transport       *countingTransport
+	timings         *requestTimings
+	client          *http.Client
 
 	wg                        sync.WaitGroup
 	atm_finished              int32
 	atm_counter_bytes_written uint64
 	atm_counter_bytes_read    uint64
+	atm_counter_failed_ops    uint64
+	atm_counter_failed_bytes  uint64
+	atm_counter_mismatches    uint64
+	atm_connections           uint64
 
 	objectsWritten int
+
+	latencyMu sync.Mutex
+	latency   *latencyHistogram
 }
 
-func NewS3Tester(endpoint string, accessKey string, secretKey string, bucketname string, uniqueId string, concurrency int, duration int) (*S3Tester, error) {
+func NewS3Tester(endpoint string, accessKey string, secretKey string, bucketname string, uniqueId string, concurrency int, duration int, opts S3Options) (*S3Tester, error) {
+
+	// The SDK's default CA bundle is trusted through the tester's own TLS
+	// configuration, as the SDK cannot add it to the tester's transport.
+	if opts.CABundle == "" {
+		opts.CABundle = os.Getenv("AWS_CA_BUNDLE")
+	}
+
+	s3Tester := &S3Tester{endpoint: endpoint, accessKey: accessKey, secretKey: secretKey, bucket: bucketname, uniqueId: uniqueId, concurrency: concurrency, durationSeconds: duration, opts: opts, objectsWritten: 0}
+	if opts.SourceIP != "" && net.ParseIP(opts.SourceIP) == nil {
+		return nil, fmt.Errorf("[error] Invalid source address %s.", opts.SourceIP)
+	}
 
-	s3Tester := &S3Tester{endpoint: endpoint, accessKey: accessKey, secretKey: secretKey, bucket: bucketname, uniqueId: uniqueId, concurrency: concurrency, durationSeconds: duration, objectsWritten: 0}
+	var tlsConfig *tls.Config
+	if opts.UseTLS {
+		var err error
+		tlsConfig, err = newTLSConfig(opts.CABundle, opts.InsecureSkipVerify)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Keep enough idle connections for every worker to reuse its own, for
+	// each of the parts s3manager transfers in parallel.
+	idleConns := concurrency * s3manager.DefaultUploadConcurrency
+	if opts.MaxConnsPerHost > 0 && opts.MaxConnsPerHost < idleConns {
+		idleConns = opts.MaxConnsPerHost
+	}
+	base := newS3Transport(s3TransportOptions{
+		MaxConnsPerHost:     opts.MaxConnsPerHost,
+		MaxIdleConnsPerHost: idleConns,
+		IdleTimeout:         opts.IdleTimeout,
+		DisableKeepAlives:   opts.DisableKeepAlives,
+		SocketBuffer:        opts.SocketBuffer,
+		SourceIP:            opts.SourceIP,
+		TLSConfig:           tlsConfig,
+	}, &s3Tester.atm_connections)
+	s3Tester.timings = newRequestTimings()
+	s3Tester.transport = newCountingTransport(newTracingTransport(base, s3Tester.timings))
+	s3Tester.client = &http.Client{Transport: s3Tester.transport}
+
+	maxSkew := opts.MaxClockSkew
+	if maxSkew == 0 {
+		maxSkew = s3SignatureTolerance
+	}
+	skew, err := measureClockSkew(s3Tester.client, s3Tester.endpointURL()+"/")
+	if err != nil {
+		fmt.Println("Unable to measure clock skew with S3 endpoint.", err)
+	} else if err := checkClockSkew("S3 endpoint "+endpoint, skew, maxSkew); err != nil {
+		return nil, err
+	}
 
 	sess := s3Tester.newSession()
 	svc := s3.New(sess)
 
+	creds, err := sess.Config.Credentials.Get()
+	if err != nil {
+		return nil, fmt.Errorf("[error] Unable to find S3 credentials: %v", err)
+	}
+	fmt.Printf("Using S3 credentials from %s, access key %s\n", creds.ProviderName, maskAccessKey(creds.AccessKeyID))
+
 	count := 0
-	err := svc.ListObjectsPages(&s3.ListObjectsInput{
+	err = svc.ListObjectsPages(&s3.ListObjectsInput{
 		Bucket: &bucketname,
 	}, func(p *s3.ListObjectsOutput, _ bool) (shouldContinue bool) {
 		count += len(p.Contents)
 		return true
 	})
 	if err != nil {
-		fmt.Println("failed to list objects", err)
+		printS3Error("failed to list objects", err)
 		return nil, err
 	}
 	if count != 0 {
@@ -58,57 +174,114 @@ func NewS3Tester(endpoint string, accessKey string, secretKey string, bucketname
 	return s3Tester, err
 }
 
+// endpointURL returns the URL of the S3 endpoint, with scheme and port.
+func (s *S3Tester) endpointURL() string {
+	scheme := "http://"
+	if s.opts.UseTLS {
+		scheme = "https://"
+	}
+	host := s.endpoint
+	if s.opts.Port > 0 {
+		host = net.JoinHostPort(host, strconv.Itoa(s.opts.Port))
+	} else if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		host = "[" + host + "]"
+	}
+	return scheme + host
+}
+
 func (s *S3Tester) newSession() *session.Session {
-	s3Config := &aws.Config{
-		Endpoint:         aws.String(s.endpoint),
-		Region:           aws.String("us-east-1"),
-		DisableSSL:       aws.Bool(true),
-		S3ForcePathStyle: aws.Bool(true),
+	region := s.opts.Region
+	if region == "" {
+		region = "us-east-1"
 	}
-	if s.accessKey != "" {
-		s3Config.Credentials = credentials.NewStaticCredentials(s.accessKey, s.secretKey, "")
+	s3Config := &aws.Config{
+		Endpoint:         aws.String(s.endpointURL()),
+		Region:           aws.String(region),
+		DisableSSL:       aws.Bool(!s.opts.UseTLS),
+		S3ForcePathStyle: aws.Bool(!s.opts.VirtualHosted),
+		// A CA bundle from AWS_CA_BUNDLE or the shared config can only be
+		// loaded into a client of the SDK's own, so the session is created
+		// with one and given the tester's client afterwards. The tester's
+		// client trusts the bundle through newTLSConfig.
+		HTTPClient: &http.Client{},
 	}
+	s3Config.Credentials = s.s3Credentials()
 
-	return session.Must(session.NewSession(s3Config))
+	sess := session.Must(session.NewSessionWithOptions(session.Options{Config: *s3Config}))
+	sess.Config.HTTPClient = s.client
+	return sess
 }
 
 func (s *S3Tester) writeOneObject(sname string) {
 
 	defer s.wg.Done()
-	src := make([]byte, 8*1024*1024)
-	rand.Read(src)
-	r := bytes.NewReader(src)
+	src := make([]byte, testObjectSize)
+	if s.opts.Verify {
+		fillVerifyBlocks(src, verifyFileId(sname), s.opts.Seed, 0)
+	} else {
+		rand.Read(src)
+	}
 
 	sess := s.newSession()
 	svc := s3manager.NewUploader(sess)
 
 	bytes_written := uint64(0)
+	failed_ops := uint64(0)
+	failed_bytes := uint64(0)
+	latency := newLatencyHistogram()
 
 	for atomic.LoadInt32(&s.atm_finished) == 0 {
 
-		_, err := svc.Upload(&s3manager.UploadInput{
+		// Bytes are counted by the transport as they are acknowledged, so
+		// only data that actually reached the server is included.
+		counter := &transferCounter{}
+		start := time.Now()
+		_, err := svc.UploadWithContext(withTransferCounter(context.Background(), counter), &s3manager.UploadInput{
 			Bucket: &s.bucket,
 			Key:    &sname,
-			Body:   r,
+			Body:   bytes.NewReader(src),
 		})
+		failed_bytes += counter.FailedBytes()
 		if err != nil {
-			fmt.Println("error", err)
+			printS3Error("error", err)
+			failed_ops++
+			failed_bytes += counter.Bytes()
+			continue
 		}
-		bytes_written += uint64(len(src))
+		latency.RecordSince(start)
+		bytes_written += counter.Bytes()
 	}
 
 	atomic.AddUint64(&s.atm_counter_bytes_written, bytes_written)
+	atomic.AddUint64(&s.atm_counter_failed_ops, failed_ops)
+	atomic.AddUint64(&s.atm_counter_failed_bytes, failed_bytes)
+	s.mergeLatency(latency)
+}
+
+// mergeLatency adds a worker's latency histogram to the current phase.
+func (s *S3Tester) mergeLatency(h *latencyHistogram) {
+	s.latencyMu.Lock()
+	defer s.latencyMu.Unlock()
+	s.latency.Merge(h)
 }
 
+// testObjectSize is the size of each object written by WriteTest.
+const testObjectSize = 8 * 1024 * 1024
+
 func generateTestObjectName(prefix string, i int) string {
 	oname := "objname-" + prefix + "-" + strconv.Itoa(i)
 	return oname
 }
 
-func (s *S3Tester) WriteTest() float64 {
+func (s *S3Tester) WriteTest() PhaseResult {
 
 	atomic.StoreInt32(&s.atm_finished, 0)
 	atomic.StoreUint64(&s.atm_counter_bytes_written, 0)
+	atomic.StoreUint64(&s.atm_counter_failed_ops, 0)
+	atomic.StoreUint64(&s.atm_counter_failed_bytes, 0)
+	atomic.StoreUint64(&s.atm_connections, 0)
+	s.latency = newLatencyHistogram()
+	s.timings.Reset()
 
 	for i := 1; i <= s.concurrency; i++ {
 		prefix := generateTestObjectName(s.uniqueId, i)
@@ -122,7 +295,12 @@ func (s *S3Tester) WriteTest() float64 {
 	s.objectsWritten += s.concurrency
 
 	total_bytes := atomic.LoadUint64(&s.atm_counter_bytes_written)
-	return float64(total_bytes) / float64(s.durationSeconds)
+	failed_ops := atomic.LoadUint64(&s.atm_counter_failed_ops)
+	failed_bytes := atomic.LoadUint64(&s.atm_counter_failed_bytes)
+	result := newPhaseResult(total_bytes, failed_ops, failed_bytes, s.latency, s.durationSeconds)
+	result.ConnectionsOpened = atomic.LoadUint64(&s.atm_connections)
+	result.Timing = s.timings.Summary()
+	return result
 }
 
 func (s *S3Tester) readOneObject(prefix string) {
@@ -132,29 +310,60 @@ func (s *S3Tester) readOneObject(prefix string) {
 	sess := s.newSession()
 	downloader := s3manager.NewDownloader(sess)
 
-	nullSink := newNullWriterAt()
+	bytes_read := uint64(0)
+	failed_ops := uint64(0)
+	latency := newLatencyHistogram()
+	verifier := newBlockVerifier(prefix, s.endpoint, s.opts.Seed)
 
 	for atomic.LoadInt32(&s.atm_finished) == 0 {
 
-		_, err := downloader.Download(nullSink, &s3.GetObjectInput{
+		// The downloader writes parts concurrently, so each download gets
+		// its own concurrency-safe sink and only completed downloads count.
+		// Verification needs the whole object, so it downloads to memory.
+		sink := newCountingSink()
+		var dst io.WriterAt = sink
+		var buf *aws.WriteAtBuffer
+		if s.opts.Verify {
+			buf = aws.NewWriteAtBuffer(make([]byte, 0, testObjectSize))
+			dst = buf
+		}
+		start := time.Now()
+		_, err := downloader.Download(dst, &s3.GetObjectInput{
 			Bucket: &s.bucket,
 			Key:    &prefix,
 		})
 		if err != nil {
-			fmt.Println("failed to download object", err)
+			printS3Error("failed to download object", err)
+			failed_ops++
+			continue
 		}
+		latency.RecordSince(start)
+		if s.opts.Verify {
+			sink.Write(buf.Bytes())
+			verifier.Write(buf.Bytes())
+			verifier.EndOfStream()
+		}
+		bytes_read += sink.Bytes()
 	}
-	atomic.AddUint64(&s.atm_counter_bytes_read, nullSink.bytesRead)
+	atomic.AddUint64(&s.atm_counter_bytes_read, bytes_read)
+	atomic.AddUint64(&s.atm_counter_failed_ops, failed_ops)
+	atomic.AddUint64(&s.atm_counter_mismatches, verifier.Mismatches())
+	s.mergeLatency(latency)
 }
 
-func (s *S3Tester) ReadTest() float64 {
+func (s *S3Tester) ReadTest() PhaseResult {
 
 	if s.objectsWritten == 0 {
 		fmt.Println("[error] Unable to perform S3 ReadTest, no objects written.")
-		return float64(0)
+		return PhaseResult{}
 	}
 	atomic.StoreInt32(&s.atm_finished, 0)
 	atomic.StoreUint64(&s.atm_counter_bytes_read, 0)
+	atomic.StoreUint64(&s.atm_counter_failed_ops, 0)
+	atomic.StoreUint64(&s.atm_counter_mismatches, 0)
+	atomic.StoreUint64(&s.atm_connections, 0)
+	s.latency = newLatencyHistogram()
+	s.timings.Reset()
 
 	for i := 1; i <= s.objectsWritten; i++ {
 		prefix := generateTestObjectName(s.uniqueId, i)
@@ -167,7 +376,13 @@ func (s *S3Tester) ReadTest() float64 {
 	s.wg.Wait()
 
 	total_bytes := atomic.LoadUint64(&s.atm_counter_bytes_read)
-	return float64(total_bytes) / float64(s.durationSeconds)
+	failed_ops := atomic.LoadUint64(&s.atm_counter_failed_ops)
+	result := newPhaseResult(total_bytes, failed_ops, 0, s.latency, s.durationSeconds)
+	result.Verified = s.opts.Verify
+	result.Mismatches = atomic.LoadUint64(&s.atm_counter_mismatches)
+	result.ConnectionsOpened = atomic.LoadUint64(&s.atm_connections)
+	result.Timing = s.timings.Summary()
+	return result
 }
 
 func (s *S3Tester) Cleanup() error {
@@ -187,6 +402,15 @@ func (s *S3Tester) Cleanup() error {
 		},
 	}
 
-	_, err := svc.DeleteObjects(input)
-	return err
+	// Abort incomplete uploads even if the objects could not be deleted.
+	var deleteErr error
+	if len(keylist) > 0 {
+		_, deleteErr = svc.DeleteObjects(input)
+	}
+
+	aborted, abortErr := s.abortIncompleteUploads(svc)
+	if aborted > 0 {
+		fmt.Printf("Aborted %d incomplete multipart uploads.\n", aborted)
+	}
+	return joinErrors(deleteErr, abortErr)
 }
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestS3Tester returns an S3Tester for a bucket of the test server, with
+// the server's credentials and one-second tests.
+func newTestS3Tester(t *testing.T, s *testS3Server, bucket string, concurrency int) (*S3Tester, error) {
+	host, port := s.hostPort(t)
+	return NewS3Tester(host, s.accessKey, s.secretKey, bucket, "test", concurrency, 1, S3Options{Port: port, Verify: true, Seed: 1})
+}
+
+func TestNewS3TesterBucketChecks(t *testing.T) {
+	s := startTestS3Server(t, "bench")
+
+	// Counting the objects of a bucket that is not empty follows every
+	// page of the listing.
+	s.set(func() {
+		for i := 0; i < 1500; i++ {
+			s.buckets["bench"]["existing-"+strconv.Itoa(i)] = nil
+		}
+	})
+	if _, err := newTestS3Tester(t, s, "bench", 1); err != nil {
+		t.Fatal(err)
+	}
+	if pages := s.requestCount("ListObjects"); pages != 2 {
+		t.Errorf("listed the bucket in %d pages, want 2", pages)
+	}
+
+	if _, err := newTestS3Tester(t, s, "missing", 1); err == nil || !strings.Contains(err.Error(), "NoSuchBucket") {
+		t.Errorf("testing a missing bucket: got %v", err)
+	}
+
+	host, port := s.hostPort(t)
+	_, err := NewS3Tester(host, s.accessKey, "wrong-secret", "bench", "test", 1, 1, S3Options{Port: port})
+	if err == nil || diagnoseS3Error(err) != s3ErrorHints["SignatureDoesNotMatch"] {
+		t.Errorf("testing with the wrong secret key: got %v", err)
+	}
+}
+
+func TestS3TesterWriteReadCleanup(t *testing.T) {
+	s := startTestS3Server(t, "bench")
+
+	st, err := newTestS3Tester(t, s, "bench", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write := st.WriteTest()
+	if write.BytesPerSec == 0 || write.FailedOps != 0 || write.FailedBytes != 0 {
+		t.Errorf("write test: %+v", write)
+	}
+	// Write throughput counts exactly the bytes the server acknowledged.
+	s.mu.Lock()
+	acked := s.ackedBytes
+	s.mu.Unlock()
+	if got := uint64(write.BytesPerSec * float64(st.durationSeconds)); got != acked {
+		t.Errorf("write test counted %d bytes, server acknowledged %d", got, acked)
+	}
+	if write.ConnectionsOpened == 0 || write.Timing == nil || write.Timing.TTFB.Count == 0 {
+		t.Errorf("write test connections and timing: %+v", write)
+	}
+	if keys := s.keys("bench"); len(keys) != 2 {
+		t.Errorf("write test left objects %v, want 2", keys)
+	}
+
+	read := st.ReadTest()
+	if read.BytesPerSec == 0 || read.FailedOps != 0 {
+		t.Errorf("read test: %+v", read)
+	}
+	if !read.Verified || read.Mismatches != 0 {
+		t.Errorf("read test verification: %+v", read)
+	}
+
+	// Cleanup aborts this client's incomplete uploads, and leaves other
+	// clients' objects and uploads alone.
+	s.set(func() {
+		s.buckets["bench"]["objname-other-1"] = nil
+		s.uploads["left-behind"] = &testUpload{bucket: "bench", key: "multipart-test-9", parts: map[int][]byte{}}
+		s.uploads["other-client"] = &testUpload{bucket: "bench", key: "multipart-other-1", parts: map[int][]byte{}}
+	})
+	if err := st.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if keys := s.keys("bench"); len(keys) != 1 || keys[0] != "objname-other-1" {
+		t.Errorf("cleanup left objects %v, want [objname-other-1]", keys)
+	}
+	s.mu.Lock()
+	_, left := s.uploads["left-behind"]
+	_, other := s.uploads["other-client"]
+	s.mu.Unlock()
+	if left || !other {
+		t.Errorf("after cleanup, own upload remains: %v, other client's upload remains: %v", left, other)
+	}
+}
+
+func TestS3TesterWriteFailures(t *testing.T) {
+	s := startTestS3Server(t, "bench")
+	st, err := newTestS3Tester(t, s, "bench", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every part fails, even when retried, so no upload completes.
+	s.set(func() { s.failOp, s.failCount = "UploadPart", -1 })
+	write := st.WriteTest()
+	if write.BytesPerSec != 0 || write.FailedOps == 0 || write.FailedBytes == 0 {
+		t.Errorf("write test with failing parts: %+v", write)
+	}
+	if n := s.uploadCount(); n != 0 {
+		t.Errorf("%d failed uploads were not aborted", n)
+	}
+}
+
+func TestS3TesterRetriedWrite(t *testing.T) {
+	s := startTestS3Server(t, "bench")
+	st, err := newTestS3Tester(t, s, "bench", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first part fails once and succeeds when retried. Its failed
+	// attempt counts towards the failed bytes, but the upload does not fail.
+	s.set(func() { s.failOp, s.failCount = "UploadPart", 1 })
+	write := st.WriteTest()
+	if write.BytesPerSec == 0 || write.FailedOps != 0 || write.FailedBytes == 0 {
+		t.Errorf("write test with a retried part: %+v", write)
+	}
+	s.mu.Lock()
+	acked := s.ackedBytes
+	s.mu.Unlock()
+	if got := uint64(write.BytesPerSec * float64(st.durationSeconds)); got != acked {
+		t.Errorf("write test counted %d bytes, server acknowledged %d", got, acked)
+	}
+}
+
+func TestS3TesterSlowResponses(t *testing.T) {
+	s := startTestS3Server(t, "bench")
+	st, err := newTestS3Tester(t, s, "bench", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const delay = 50 * time.Millisecond
+	s.set(func() { s.delay = delay })
+	write := st.WriteTest()
+	if write.FailedOps != 0 || write.Latency.Count == 0 {
+		t.Fatalf("write test: %+v", write)
+	}
+	// Each upload makes at least three requests one after another: create,
+	// parts, complete. The percentiles are accurate to within a few percent.
+	if write.Latency.P50 < 3*delay*9/10 {
+		t.Errorf("write latency p50 is %s with %s per request", write.Latency.P50, delay)
+	}
+	if write.Timing == nil || write.Timing.TTFB.P50 < delay*9/10 {
+		t.Errorf("time to first byte with %s per request: %+v", delay, write.Timing)
+	}
+}
+
+func TestS3TesterRangedRead(t *testing.T) {
+	s := startTestS3Server(t, "bench")
+	st, err := newTestS3Tester(t, s, "bench", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.WriteTest()
+
+	ranged, op := st.RangedReadTest(64*1024, 64*1024, rangePatternStrided)
+	if ranged.BytesPerSec == 0 || ranged.FailedOps != 0 || op.Ops == 0 {
+		t.Errorf("ranged read test: %+v %+v", ranged, op)
+	}
+	if got := uint64(ranged.BytesPerSec * float64(st.durationSeconds)); got != op.Ops*64*1024 {
+		t.Errorf("ranged read test read %d bytes in %d requests of 64 KiB", got, op.Ops)
+	}
+	// The GETs' own trace and the transport's request timing both see the
+	// first response byte.
+	if op.TTFB == nil || op.TTFB.Count != op.Ops || ranged.Timing == nil || ranged.Timing.TTFB.Count < op.Ops {
+		t.Errorf("time to first byte of %d requests: %+v, request timing %+v", op.Ops, op.TTFB, ranged.Timing)
+	}
+}
+
+func TestS3TesterListPaging(t *testing.T) {
+	s := startTestS3Server(t, "bench")
+	st, err := newTestS3Tester(t, s, "bench", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 50 keys over 5 prefixes, listed 7 at a time.
+	results := st.ListTest(50, 5, []int{7})
+	want := map[string][2]uint64{
+		"LIST max-keys=7 flat": {8, 50},
+		// One page of the 5 prefixes, then 2 pages of 10 keys for each.
+		"LIST max-keys=7 delimited": {11, 55},
+	}
+	for _, r := range results {
+		if r.Operation == "LIST-POPULATE" && r.ConnectionsOpened == 0 {
+			t.Errorf("%s: no connections opened", r.Operation)
+		}
+		w, ok := want[r.Operation]
+		if !ok {
+			continue
+		}
+		delete(want, r.Operation)
+		if r.FailedOps != 0 || r.Ops != w[0] || r.Items != w[1] {
+			t.Errorf("%s: %d pages of %d items, %d failed, want %d pages of %d items", r.Operation, r.Ops, r.Items, r.FailedOps, w[0], w[1])
+		}
+	}
+	if len(want) != 0 {
+		t.Errorf("missing results %v", want)
+	}
+	if keys := s.keys("bench"); len(keys) != 0 {
+		t.Errorf("list test left %d keys", len(keys))
+	}
+}
+
+func TestNewS3TesterCABundleFromEnvironment(t *testing.T) {
+	s := startTestS3Server(t, "bench")
+	srv := httptest.NewTLSServer(s.srv.Config.Handler)
+	defer srv.Close()
+
+	bundle := filepath.Join(t.TempDir(), "ca.pem")
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := ioutil.WriteFile(bundle, cert, 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("AWS_CA_BUNDLE", bundle)
+
+	// The server's certificate is trusted only through the bundle, which
+	// is left in the environment.
+	addr := srv.Listener.Addr().(*net.TCPAddr)
+	_, err := NewS3Tester(addr.IP.String(), s.accessKey, s.secretKey, "bench", "test", 1, 1, S3Options{UseTLS: true, Port: addr.Port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := os.Getenv("AWS_CA_BUNDLE"); got != bundle {
+		t.Errorf("AWS_CA_BUNDLE is %q after creating the tester, want %q", got, bundle)
+	}
+}
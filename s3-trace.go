@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RequestTiming breaks HTTP request latency into phases. DNS, Connect and
+// TLS only occur on new connections, so their counts show how many requests
+// opened one. Send is from getting a connection until the request, including
+// its body, is written; TTFB from then until the response headers arrive,
+// i.e. network round trip plus server processing; and Transfer from then until
+// the response body is read.
+type RequestTiming struct {
+	DNS      LatencySummary `json:"dns"`
+	Connect  LatencySummary `json:"connect"`
+	TLS      LatencySummary `json:"tls"`
+	Send     LatencySummary `json:"send"`
+	TTFB     LatencySummary `json:"ttfb"`
+	Transfer LatencySummary `json:"transfer"`
+}
+
+// Request phases, indexing requestTimings.
+const (
+	timingDNS = iota
+	timingConnect
+	timingTLS
+	timingSend
+	timingTTFB
+	timingTransfer
+	numTimings
+)
+
+// requestTimings accumulates the phase durations of all requests made through
+// a tracingTransport.
+type requestTimings struct {
+	mu     sync.Mutex
+	phases [numTimings]*latencyHistogram
+}
+
+func newRequestTimings() *requestTimings {
+	t := &requestTimings{}
+	t.Reset()
+	return t
+}
+
+// Reset discards all recorded durations, at the start of a phase.
+func (t *requestTimings) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := range t.phases {
+		t.phases[i] = newLatencyHistogram()
+	}
+}
+
+func (t *requestTimings) record(phase int, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.phases[phase].Record(d)
+}
+
+func (t *requestTimings) Summary() *RequestTiming {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return &RequestTiming{
+		DNS:      t.phases[timingDNS].Summary(),
+		Connect:  t.phases[timingConnect].Summary(),
+		TLS:      t.phases[timingTLS].Summary(),
+		Send:     t.phases[timingSend].Summary(),
+		TTFB:     t.phases[timingTTFB].Summary(),
+		Transfer: t.phases[timingTransfer].Summary(),
+	}
+}
+
+// tracingTransport is an http.RoundTripper that records the phase durations
+// of every request with httptrace.
+type tracingTransport struct {
+	base    http.RoundTripper
+	timings *requestTimings
+}
+
+func newTracingTransport(base http.RoundTripper, timings *requestTimings) *tracingTransport {
+	return &tracingTransport{base: base, timings: timings}
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+
+	// The callbacks run on the transport's goroutines, and connections to
+	// several addresses of a host may be attempted at once, so connect
+	// starts are kept by address.
+	var mu sync.Mutex
+	var gotConn, wroteRequest time.Time
+	var dnsStart, tlsStart time.Time
+	connectStart := make(map[string]time.Time)
+	start := func(t *time.Time) {
+		mu.Lock()
+		defer mu.Unlock()
+		*t = time.Now()
+	}
+	since := func(t *time.Time) time.Duration {
+		mu.Lock()
+		defer mu.Unlock()
+		return time.Since(*t)
+	}
+	timings := t.timings
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { start(&dnsStart) },
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			timings.record(timingDNS, since(&dnsStart))
+		},
+		ConnectStart: func(network string, addr string) {
+			mu.Lock()
+			defer mu.Unlock()
+			connectStart[network+" "+addr] = time.Now()
+		},
+		ConnectDone: func(network string, addr string, err error) {
+			mu.Lock()
+			started := connectStart[network+" "+addr]
+			mu.Unlock()
+			if err == nil {
+				timings.record(timingConnect, time.Since(started))
+			}
+		},
+		TLSHandshakeStart: func() { start(&tlsStart) },
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			if err == nil {
+				timings.record(timingTLS, since(&tlsStart))
+			}
+		},
+		GotConn: func(httptrace.GotConnInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			gotConn = time.Now()
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			wroteRequest = time.Now()
+		},
+	}
+
+	resp, err := t.base.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	if err != nil {
+		return resp, err
+	}
+
+	// RoundTrip returns once the final response's headers arrive; an
+	// interim 100 Continue is not the first byte of the response.
+	firstByte := time.Now()
+	mu.Lock()
+	sent, wrote := gotConn, wroteRequest
+	mu.Unlock()
+	if !wrote.IsZero() {
+		timings.record(timingSend, wrote.Sub(sent))
+		timings.record(timingTTFB, firstByte.Sub(wrote))
+	}
+	resp.Body = &transferTimer{ReadCloser: resp.Body, start: firstByte, timings: timings}
+	return resp, nil
+}
+
+// transferTimer records the time from the first response byte until the
+// body is read to the end or closed.
+type transferTimer struct {
+	io.ReadCloser
+	start   time.Time
+	timings *requestTimings
+	once    sync.Once
+}
+
+func (b *transferTimer) done() {
+	b.once.Do(func() {
+		b.timings.record(timingTransfer, time.Since(b.start))
+	})
+}
+
+func (b *transferTimer) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.done()
+	}
+	return n, err
+}
+
+func (b *transferTimer) Close() error {
+	b.done()
+	return b.ReadCloser.Close()
+}
+
+// formatRequestTiming returns the p50 and p99 of each phase that occurred.
+func formatRequestTiming(r *RequestTiming) string {
+	var parts []string
+	for _, phase := range []struct {
+		name string
+		l    LatencySummary
+	}{
+		{"dns", r.DNS}, {"connect", r.Connect}, {"tls", r.TLS},
+		{"send", r.Send}, {"ttfb", r.TTFB}, {"transfer", r.Transfer},
+	} {
+		if phase.l.Count > 0 {
+			parts = append(parts, fmt.Sprintf("%s = %s/%s", phase.name, formatLatency(phase.l.P50), formatLatency(phase.l.P99)))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
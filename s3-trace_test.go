@@ -0,0 +1,36 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTracingTransportPhases(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "response body")
+	}))
+	defer srv.Close()
+
+	timings := newRequestTimings()
+	client := &http.Client{Transport: newTracingTransport(srv.Client().Transport, timings)}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	// The second request reuses the first one's connection.
+	got := timings.Summary()
+	if got.Connect.Count != 1 || got.TLS.Count != 1 {
+		t.Errorf("recorded %d connects and %d TLS handshakes, want 1 each", got.Connect.Count, got.TLS.Count)
+	}
+	if got.Send.Count != 2 || got.TTFB.Count != 2 || got.Transfer.Count != 2 {
+		t.Errorf("recorded %d sends, %d TTFBs and %d transfers, want 2 each", got.Send.Count, got.TTFB.Count, got.Transfer.Count)
+	}
+}
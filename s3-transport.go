@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// transferCounter accumulates the payload bytes of the HTTP requests issued
+// on behalf of a single S3 operation: atm_bytes those of successful requests,
+// and atm_bytes_failed those sent in failed or retried requests.
+type transferCounter struct {
+	atm_bytes        uint64
+	atm_bytes_failed uint64
+}
+
+func (c *transferCounter) Bytes() uint64 {
+	return atomic.LoadUint64(&c.atm_bytes)
+}
+
+func (c *transferCounter) FailedBytes() uint64 {
+	return atomic.LoadUint64(&c.atm_bytes_failed)
+}
+
+type transferCounterKey struct{}
+
+// withTransferCounter returns a context that makes countingTransport
+// attribute request payload bytes to the given counter.
+func withTransferCounter(ctx context.Context, c *transferCounter) context.Context {
+	return context.WithValue(ctx, transferCounterKey{}, c)
+}
+
+// countingReadCloser counts the bytes the HTTP transport reads out of a
+// request body, i.e. the bytes actually put on the wire.
+type countingReadCloser struct {
+	io.ReadCloser
+	counter *uint64
+}
+
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	atomic.AddUint64(c.counter, uint64(n))
+	return n, err
+}
+
+// countingTransport is an http.RoundTripper that measures request payload
+// bytes. Bytes are only credited to the operation's transferCounter if the
+// server acknowledged the request with a 2xx status; bytes sent in failed or
+// retried requests are credited to its failed bytes.
+type countingTransport struct {
+	base http.RoundTripper
+}
+
+func newCountingTransport(base http.RoundTripper) *countingTransport {
+	return &countingTransport{base: base}
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+
+	counter, ok := req.Context().Value(transferCounterKey{}).(*transferCounter)
+	if !ok || req.Body == nil || req.Body == http.NoBody {
+		return t.base.RoundTrip(req)
+	}
+
+	sent := new(uint64)
+	r := req.Clone(req.Context())
+	r.Body = &countingReadCloser{ReadCloser: req.Body, counter: sent}
+	if req.GetBody != nil {
+		// If the transport rewinds the body to resend it, only the final
+		// attempt counts towards the bytes sent.
+		r.GetBody = func() (io.ReadCloser, error) {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			atomic.AddUint64(&counter.atm_bytes_failed, atomic.SwapUint64(sent, 0))
+			return &countingReadCloser{ReadCloser: body, counter: sent}, nil
+		}
+	}
+
+	resp, err := t.base.RoundTrip(r)
+	if err != nil || resp.StatusCode < 200 || resp.StatusCode > 299 {
+		atomic.AddUint64(&counter.atm_bytes_failed, atomic.LoadUint64(sent))
+	} else {
+		atomic.AddUint64(&counter.atm_bytes, atomic.LoadUint64(sent))
+	}
+	return resp, err
+}
+
+// s3TransportOptions tunes the HTTP transport shared by an S3Tester.
+type s3TransportOptions struct {
+	// MaxConnsPerHost limits the connections to the endpoint; zero is
+	// unlimited. MaxIdleConnsPerHost is the number kept open for reuse.
+	MaxConnsPerHost     int
+	MaxIdleConnsPerHost int
+	IdleTimeout         time.Duration
+	DisableKeepAlives   bool
+
+	// SocketBuffer, if non-zero, sets the send and receive buffer size of
+	// each connection, in bytes.
+	SocketBuffer int
+	SourceIP     string
+
+	// TLSConfig, if set, is used for HTTPS connections.
+	TLSConfig *tls.Config
+}
+
+// newS3Transport returns an HTTP transport built from http.DefaultTransport
+// with the given tuning, which adds one to *connections for each TCP
+// connection it opens.
+func newS3Transport(opts s3TransportOptions, connections *uint64) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxConnsPerHost = opts.MaxConnsPerHost
+	t.MaxIdleConnsPerHost = opts.MaxIdleConnsPerHost
+	if t.MaxIdleConns < opts.MaxIdleConnsPerHost {
+		t.MaxIdleConns = opts.MaxIdleConnsPerHost
+	}
+	if opts.IdleTimeout > 0 {
+		t.IdleConnTimeout = opts.IdleTimeout
+	}
+	t.DisableKeepAlives = opts.DisableKeepAlives
+	if opts.TLSConfig != nil {
+		t.TLSClientConfig = opts.TLSConfig
+	}
+
+	dialer := newBoundDialer(opts.SourceIP)
+	if opts.SocketBuffer > 0 {
+		// The buffers are set before connecting, so that the TCP window
+		// scale negotiated in the handshake allows for them.
+		dialer.Control = func(network string, address string, c syscall.RawConn) error {
+			var err error
+			cerr := c.Control(func(fd uintptr) {
+				err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, opts.SocketBuffer)
+				if err == nil {
+					err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF, opts.SocketBuffer)
+				}
+			})
+			if cerr != nil {
+				return cerr
+			}
+			return err
+		}
+	}
+	t.DialContext = func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		atomic.AddUint64(connections, 1)
+		return conn, nil
+	}
+	return t
+}
+
+// newTLSConfig returns a TLS configuration that trusts the system roots plus
+// the certificates in caBundle, if given, or skips verification entirely.
+func newTLSConfig(caBundle string, insecure bool) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: insecure}
+	if caBundle == "" {
+		return config, nil
+	}
+
+	pem, err := ioutil.ReadFile(caBundle)
+	if err != nil {
+		return nil, fmt.Errorf("[error] Unable to read CA bundle: %v", err)
+	}
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("[error] No certificates found in CA bundle %s.", caBundle)
+	}
+	config.RootCAs = roots
+	return config, nil
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The sequential write and read tests run the same way against the
+// userspace NFS client and a locally mounted path. seqTester holds what they
+// share, and each tester opens its files through a seqOpener.
+
+// seqFile is a test file open for sequential writes or reads.
+type seqFile interface {
+	WriteAt(p []byte, off int64) (int, error)
+	// ReadAt is as io.ReaderAt: it returns io.EOF when it reads fewer than
+	// len(p) bytes because the file ends.
+	ReadAt(p []byte, off int64) (int, error)
+	Sync() error
+	Close() error
+}
+
+// seqOpener opens the files of worker i, numbered from 1.
+type seqOpener interface {
+	createFile(i int, fname string) (seqFile, error)
+	openFile(i int, fname string) (seqFile, error)
+}
+
+// seqOptions holds the settings of the sequential tests, with the same
+// meaning as the corresponding NFSOptions.
+type seqOptions struct {
+	Verify bool
+	Seed   uint64
+
+	FileSize       uint64
+	FilesPerWorker int
+
+	// SyncBytes, if set, syncs each file after every SyncBytes written, and
+	// SyncOnClose syncs each file when the writer moves on from it.
+	SyncBytes   uint64
+	SyncOnClose bool
+}
+
+type seqTester struct {
+	concurrency     int
+	durationSeconds int
+	uniqueId        string
+	seq             seqOptions
+	files           seqOpener
+
+	// namePrefix is prepended to the test file names, and source names the
+	// server in data verification reports.
+	namePrefix string
+	source     string
+
+	// Size of each write and read call.
+	writeSize int
+	readSize  int
+
+	wg                        sync.WaitGroup
+	atm_finished              int32
+	atm_counter_bytes_written uint64
+	atm_counter_bytes_read    uint64
+	atm_counter_failed_ops    uint64
+	atm_counter_failed_bytes  uint64
+	atm_counter_mismatches    uint64
+	filesWritten              int
+
+	// created holds the files each writer of the last write test created,
+	// indexed by worker from zero, which are the files its reader reads.
+	created [][]string
+
+	latencyMu sync.Mutex
+	latency   *latencyHistogram
+
+	// Syncs of the last write test, guarded by latencyMu, and the time the
+	// test took.
+	syncLatency  *latencyHistogram
+	syncs        uint64
+	failedSyncs  uint64
+	writeElapsed time.Duration
+}
+
+func newSeqTester(uniqueId string, concurrency int, duration int, opts seqOptions) seqTester {
+	return seqTester{
+		concurrency:     concurrency,
+		durationSeconds: duration,
+		uniqueId:        uniqueId,
+		seq:             opts,
+		writeSize:       1024 * 1024,
+		readSize:        512 * 1024,
+	}
+}
+
+func generateTestFilename(baseDir string, prefix string, i int) string {
+
+	fname := baseDir + "filename-" + prefix + "-" + strconv.Itoa(i)
+	return fname
+}
+
+func (s *seqTester) filesPerWorker() int {
+	if s.seq.FilesPerWorker < 1 {
+		return 1
+	}
+	return s.seq.FilesPerWorker
+}
+
+// workerFilenames returns the files written by worker i, numbered from 1.
+func (s *seqTester) workerFilenames(i int) []string {
+	var fnames []string
+	for k := 1; k <= s.filesPerWorker(); k++ {
+		fnames = append(fnames, generateTestFilename(s.namePrefix, s.uniqueId, (i-1)*s.filesPerWorker()+k))
+	}
+	return fnames
+}
+
+// mergeLatency adds a worker's latency histogram to the current phase.
+func (s *seqTester) mergeLatency(h *latencyHistogram) {
+	s.latencyMu.Lock()
+	defer s.latencyMu.Unlock()
+	s.latency.Merge(h)
+}
+
+// writeFiles writes to fnames in turn. Without a FileSize limit it appends
+// to the first file for the whole test. With one, it rolls over to the next
+// file each time the current file reaches FileSize, and after the last file
+// starts over, rewriting the first from offset zero. Each file is opened
+// once and kept open until the test finishes.
+func (s *seqTester) writeFiles(i int, fnames []string) {
+
+	defer s.wg.Done()
+
+	srcBuf := make([]byte, s.writeSize)
+	rand.Read(srcBuf)
+
+	var bytes_written uint64
+	bytes_written = 0
+	failed_ops := uint64(0)
+	failed_bytes := uint64(0)
+	latency := newLatencyHistogram()
+	syncLatency := newLatencyHistogram()
+	syncs, failedSyncs := uint64(0), uint64(0)
+
+	files := make(map[string]seqFile)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	for k := 0; atomic.LoadInt32(&s.atm_finished) == 0; k = (k + 1) % len(fnames) {
+		fname := fnames[k]
+		f, ok := files[fname]
+		if !ok {
+			var err error
+			f, err = s.files.createFile(i, fname)
+			if err != nil {
+				fmt.Printf("OpenFile %s failed\n", fname)
+				fmt.Println(err)
+				break
+			}
+			files[fname] = f
+			s.created[i-1] = append(s.created[i-1], fname)
+		}
+
+		sync := func() {
+			start := time.Now()
+			if err := f.Sync(); err != nil {
+				if failedSyncs == 0 {
+					fmt.Printf("Sync of %s failed: %v\n", fname, err)
+				}
+				failedSyncs++
+				return
+			}
+			syncLatency.RecordSince(start)
+			syncs++
+		}
+
+		fileId := verifyFileId(fname)
+		offset := uint64(0)
+		unsynced := uint64(0)
+
+		for atomic.LoadInt32(&s.atm_finished) == 0 && (s.seq.FileSize == 0 || offset < s.seq.FileSize) {
+			buf := srcBuf
+			if s.seq.FileSize > 0 && s.seq.FileSize-offset < uint64(len(buf)) {
+				buf = buf[:s.seq.FileSize-offset]
+			}
+			if s.seq.Verify {
+				fillVerifyBlocks(buf, fileId, s.seq.Seed, offset)
+			}
+
+			// WriteAt returns the bytes the server acknowledged; a call that
+			// errors counts as a failed operation. Latency includes any wait
+			// for a shared connection.
+			start := time.Now()
+			written, err := f.WriteAt(buf, int64(offset))
+			offset += uint64(written)
+			if err != nil {
+				if failed_ops == 0 {
+					fmt.Printf("Write to %s failed: %v\n", fname, err)
+				}
+				failed_ops++
+				failed_bytes += uint64(written)
+				// Rewrite any partly written block, so that every block
+				// starts at a multiple of verifyBlockSize.
+				offset -= offset % verifyBlockSize
+				continue
+			}
+			latency.RecordSince(start)
+			bytes_written += uint64(written)
+
+			unsynced += uint64(written)
+			if s.seq.SyncBytes > 0 && unsynced >= s.seq.SyncBytes {
+				sync()
+				unsynced = 0
+			}
+		}
+		if s.seq.SyncOnClose && unsynced > 0 {
+			sync()
+		}
+	}
+
+	atomic.AddUint64(&s.atm_counter_bytes_written, bytes_written)
+	atomic.AddUint64(&s.atm_counter_failed_ops, failed_ops)
+	atomic.AddUint64(&s.atm_counter_failed_bytes, failed_bytes)
+	s.mergeLatency(latency)
+
+	s.latencyMu.Lock()
+	defer s.latencyMu.Unlock()
+	s.syncLatency.Merge(syncLatency)
+	s.syncs += syncs
+	s.failedSyncs += failedSyncs
+}
+
+// WriteTest runs the writers for the test duration. Throughput is measured
+// up to when the last writer finished, so that it includes the final sync of
+// each writer's current file.
+func (s *seqTester) WriteTest() PhaseResult {
+
+	atomic.StoreInt32(&s.atm_finished, 0)
+	atomic.StoreUint64(&s.atm_counter_bytes_written, 0)
+	atomic.StoreUint64(&s.atm_counter_failed_ops, 0)
+	atomic.StoreUint64(&s.atm_counter_failed_bytes, 0)
+	s.latency = newLatencyHistogram()
+	s.syncLatency = newLatencyHistogram()
+	s.syncs, s.failedSyncs = 0, 0
+	s.created = make([][]string, s.concurrency)
+
+	start := time.Now()
+	for i := 1; i <= s.concurrency; i++ {
+		s.wg.Add(1)
+		go s.writeFiles(i, s.workerFilenames(i))
+	}
+
+	time.Sleep(time.Duration(s.durationSeconds) * time.Second)
+	atomic.StoreInt32(&s.atm_finished, 1)
+	s.wg.Wait()
+	s.writeElapsed = time.Since(start)
+	s.filesWritten = s.concurrency * s.filesPerWorker()
+
+	total_bytes := atomic.LoadUint64(&s.atm_counter_bytes_written)
+	failed_ops := atomic.LoadUint64(&s.atm_counter_failed_ops)
+	failed_bytes := atomic.LoadUint64(&s.atm_counter_failed_bytes)
+	return newPhaseResultElapsed(total_bytes, failed_ops, failed_bytes, s.latency, s.writeElapsed)
+}
+
+// syncResult returns the syncs of the last write test as operations of the
+// given name, if any were issued.
+func (s *seqTester) syncResult(name string) (OperationResult, bool) {
+	if s.syncs+s.failedSyncs == 0 {
+		return OperationResult{}, false
+	}
+	return newOperationResult(name, s.syncs, s.failedSyncs, s.syncLatency, s.writeElapsed), true
+}
+
+// readFiles reads each of fnames from start to end in turn, cycling through
+// them until the test finishes. Each file is opened once and read again from
+// the start on each pass. A file that cannot be opened counts as a failed
+// operation and is not read again.
+func (s *seqTester) readFiles(i int, fnames []string) {
+
+	defer s.wg.Done()
+
+	p := make([]byte, s.readSize)
+	sink := newCountingSink()
+	failed_ops := uint64(0)
+	latency := newLatencyHistogram()
+	verifiers := make(map[string]*blockVerifier)
+	for _, fname := range fnames {
+		verifiers[fname] = newBlockVerifier(fname, s.source, s.seq.Seed)
+	}
+	files := make(map[string]seqFile)
+
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+
+		atomic.AddUint64(&s.atm_counter_bytes_read, sink.Bytes())
+		atomic.AddUint64(&s.atm_counter_failed_ops, failed_ops)
+		for _, v := range verifiers {
+			atomic.AddUint64(&s.atm_counter_mismatches, v.Mismatches())
+		}
+		s.mergeLatency(latency)
+	}()
+
+	for k := 0; atomic.LoadInt32(&s.atm_finished) == 0; k = (k + 1) % len(fnames) {
+		fname := fnames[k]
+		verifier := verifiers[fname]
+
+		f, ok := files[fname]
+		if !ok {
+			var err error
+			f, err = s.files.openFile(i, fname)
+			if err != nil {
+				fmt.Println(err)
+				failed_ops++
+				fnames = append(fnames[:k:k], fnames[k+1:]...)
+				if len(fnames) == 0 {
+					return
+				}
+				k--
+				continue
+			}
+			files[fname] = f
+		}
+
+		for offset := int64(0); atomic.LoadInt32(&s.atm_finished) == 0; {
+			start := time.Now()
+			count, err := f.ReadAt(p, offset)
+			if err != nil && err != io.EOF {
+				// Reopen the file rather than retrying on a handle in an
+				// unknown state.
+				failed_ops++
+				verifier.Restart()
+				f.Close()
+				delete(files, fname)
+				break
+			}
+			if count > 0 || err == io.EOF {
+				latency.RecordSince(start)
+			}
+			if count > 0 {
+				sink.Write(p[:count])
+				if s.seq.Verify {
+					verifier.Write(p[:count])
+				}
+				offset += int64(count)
+			}
+			if err == io.EOF {
+				if s.seq.Verify {
+					verifier.EndOfStream()
+				}
+				break
+			}
+		}
+	}
+}
+
+// ReadTest runs the readers for the test duration, each reading the files
+// its writer created. Throughput is measured up to when the last reader
+// finished.
+func (s *seqTester) ReadTest() PhaseResult {
+
+	readers := 0
+	for _, fnames := range s.created {
+		if len(fnames) > 0 {
+			readers++
+		}
+	}
+	if readers == 0 {
+		fmt.Println("[error] Unable to perform ReadTest, no files written.")
+		return PhaseResult{}
+	}
+	atomic.StoreInt32(&s.atm_finished, 0)
+	atomic.StoreUint64(&s.atm_counter_bytes_read, 0)
+	atomic.StoreUint64(&s.atm_counter_failed_ops, 0)
+	atomic.StoreUint64(&s.atm_counter_mismatches, 0)
+	s.latency = newLatencyHistogram()
+
+	start := time.Now()
+	for i, fnames := range s.created {
+		if len(fnames) == 0 {
+			continue
+		}
+		s.wg.Add(1)
+		go s.readFiles(i+1, fnames)
+	}
+
+	time.Sleep(time.Duration(s.durationSeconds) * time.Second)
+	atomic.StoreInt32(&s.atm_finished, 1)
+	s.wg.Wait()
+
+	total_bytes := atomic.LoadUint64(&s.atm_counter_bytes_read)
+	failed_ops := atomic.LoadUint64(&s.atm_counter_failed_ops)
+	result := newPhaseResultElapsed(total_bytes, failed_ops, 0, s.latency, time.Since(start))
+	result.Verified = s.seq.Verify
+	result.Mismatches = atomic.LoadUint64(&s.atm_counter_mismatches)
+	return result
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"testing"
+)
+
+// memOpener holds the sequential test files in memory. Every failEvery'th
+// write to a file writes only part of its data and fails.
+type memOpener struct {
+	failEvery int
+
+	mu    sync.Mutex
+	files map[string]*memFile
+}
+
+type memFile struct {
+	o *memOpener
+
+	mu      sync.Mutex
+	data    []byte
+	writes  int
+	offsets []int64
+}
+
+func (o *memOpener) createFile(i int, fname string) (seqFile, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.files == nil {
+		o.files = make(map[string]*memFile)
+	}
+	f := &memFile{o: o}
+	o.files[fname] = f
+	return f, nil
+}
+
+func (o *memOpener) openFile(i int, fname string) (seqFile, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	f, ok := o.files[fname]
+	if !ok {
+		return nil, errors.New("no such file")
+	}
+	return f, nil
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.offsets = append(f.offsets, off)
+	f.writes++
+	var err error
+	if f.o.failEvery > 0 && f.writes%f.o.failEvery == 0 {
+		p = p[:len(p)/2+100]
+		err = errors.New("write failed part way")
+	}
+	if end := off + int64(len(p)); end > int64(len(f.data)) {
+		f.data = append(f.data, make([]byte, end-int64(len(f.data)))...)
+	}
+	return copy(f.data[off:], p), err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if off >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Sync() error  { return nil }
+func (f *memFile) Close() error { return nil }
+
+func TestSeqTesterPartialWriteAlignment(t *testing.T) {
+	o := &memOpener{failEvery: 3}
+	s := newSeqTester("test", 2, 1, seqOptions{Verify: true, Seed: 1, FileSize: 2 * 1024 * 1024, FilesPerWorker: 2})
+	s.files = o
+
+	write := s.WriteTest()
+	if write.FailedOps == 0 {
+		t.Fatalf("write test had no failed writes: %+v", write)
+	}
+	// A failed write is followed by rewriting its partly written block, so
+	// every write starts on a block boundary.
+	for fname, f := range o.files {
+		for _, off := range f.offsets {
+			if off%verifyBlockSize != 0 {
+				t.Fatalf("write to %s at offset %d is not block aligned", fname, off)
+			}
+		}
+	}
+
+	read := s.ReadTest()
+	if read.BytesPerSec == 0 || !read.Verified || read.Mismatches != 0 {
+		t.Errorf("read test: %+v", read)
+	}
+}
@@ -1,25 +1,39 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
+	"sync/atomic"
 )
 
-type nullWriterAt struct {
-	bytesRead uint64
+// countingSink discards everything written to it and counts the bytes. It is
+// safe for concurrent use: s3manager.Downloader calls WriteAt from several part
+// goroutines at once, and the NFS readers share the same abstraction through
+// Write.
+type countingSink struct {
+	atm_bytes uint64
 }
 
-func newNullWriterAt() *nullWriterAt {
-	w := &nullWriterAt{bytesRead: 0}
-	return w
+func newCountingSink() *countingSink {
+	return &countingSink{}
 }
 
-func (w *nullWriterAt) WriteAt(p []byte, off int64) (int, error) {
-	w.bytesRead += uint64(len(p))
+func (w *countingSink) Write(p []byte) (int, error) {
+	atomic.AddUint64(&w.atm_bytes, uint64(len(p)))
 	return len(p), nil
 }
 
+func (w *countingSink) WriteAt(p []byte, off int64) (int, error) {
+	return w.Write(p)
+}
+
+func (w *countingSink) Bytes() uint64 {
+	return atomic.LoadUint64(&w.atm_bytes)
+}
+
 func ByteRateSI(b float64) string {
 	const unit = 1000
 	if b < unit {
@@ -43,3 +57,75 @@ func getShortHostname() string {
 	hostname = strings.Split(hostname, ".")[0]
 	return strings.ToLower(hostname)
 }
+
+// parseIntList parses a comma-separated list of positive integers.
+func parseIntList(list string) ([]int, error) {
+	var values []int
+	for _, field := range strings.Split(list, ",") {
+		v, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || v < 1 {
+			return nil, fmt.Errorf("[error] Invalid value %q in list %q, expected positive integers.", field, list)
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+// parseKiBList parses a comma-separated list of sizes in KiB, for example
+// "4,64,256", and returns the sizes in bytes.
+func parseKiBList(list string) ([]int, error) {
+	sizes, err := parseIntList(list)
+	if err != nil {
+		return nil, err
+	}
+	for i := range sizes {
+		sizes[i] *= 1024
+	}
+	return sizes, nil
+}
+
+// parseRatio parses a read:write ratio such as "70:30" and returns the
+// percentage of reads.
+func parseRatio(ratio string) (int, error) {
+	fields := strings.Split(ratio, ":")
+	if len(fields) == 2 {
+		reads, err1 := strconv.Atoi(strings.TrimSpace(fields[0]))
+		writes, err2 := strconv.Atoi(strings.TrimSpace(fields[1]))
+		if err1 == nil && err2 == nil && reads >= 0 && writes >= 0 && reads+writes > 0 {
+			return reads * 100 / (reads + writes), nil
+		}
+	}
+	return 0, fmt.Errorf("[error] Invalid ratio %q, expected reads:writes such as 70:30.", ratio)
+}
+
+// parseUint32List parses a comma-separated list of uint32 values, such as
+// group ids. An empty string gives an empty list.
+func parseUint32List(list string) ([]uint32, error) {
+	var values []uint32
+	if strings.TrimSpace(list) == "" {
+		return values, nil
+	}
+	for _, field := range strings.Split(list, ",") {
+		v, err := strconv.ParseUint(strings.TrimSpace(field), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("[error] Invalid value %q in list %q.", field, list)
+		}
+		values = append(values, uint32(v))
+	}
+	return values, nil
+}
+
+// joinErrors returns an error combining the messages of the non-nil errs, or
+// nil if there are none.
+func joinErrors(errs ...error) error {
+	var msgs []string
+	for _, err := range errs {
+		if err != nil {
+			msgs = append(msgs, err.Error())
+		}
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(msgs, "; "))
+}
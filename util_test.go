@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+// TestCountingSinkConcurrentWriteAt writes to one sink from several
+// goroutines at once, as s3manager.Downloader does; run it with -race.
+func TestCountingSinkConcurrentWriteAt(t *testing.T) {
+	sink := newCountingSink()
+	p := make([]byte, 1000)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				n, err := sink.WriteAt(p, int64(g*100+i)*int64(len(p)))
+				if n != len(p) || err != nil {
+					t.Errorf("WriteAt = %d, %v", n, err)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if got := sink.Bytes(); got != 8*100*1000 {
+		t.Errorf("sink counted %d bytes, want %d", got, 8*100*1000)
+	}
+}
+
+func TestJoinErrors(t *testing.T) {
+	if err := joinErrors(nil, nil); err != nil {
+		t.Errorf("joinErrors(nil, nil) = %v", err)
+	}
+	err := joinErrors(errors.New("delete failed"), nil, errors.New("abort failed"))
+	if err == nil || err.Error() != "delete failed; abort failed" {
+		t.Errorf("joinErrors = %v", err)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+)
+
+// Verify mode fills every verifyBlockSize block of test data with a header
+// identifying where it belongs, followed by a payload derived from the run's
+// seed. Readers check each block they receive against its expected location
+// and checksum, which catches corruption as well as misdirected data.
+const verifyBlockSize = 4096
+const verifyHeaderSize = 40
+const verifyMagic = 0x31424d554c504246 // "FBPLUMB1"
+
+// Stop printing individual mismatches after this many per file or object.
+const maxReportedMismatches = 5
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// verifyFileId derives the identifier embedded in a file or object's blocks
+// from its name.
+func verifyFileId(name string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return h.Sum64()
+}
+
+// fillVerifyBlocks fills buf, which must be a multiple of verifyBlockSize, with
+// the blocks expected at the given offset of a file.
+func fillVerifyBlocks(buf []byte, fileId uint64, seed uint64, offset uint64) {
+	for b := 0; b+verifyBlockSize <= len(buf); b += verifyBlockSize {
+		block := buf[b : b+verifyBlockSize]
+		blockOffset := offset + uint64(b)
+		payload := block[verifyHeaderSize:]
+
+		// xorshift64 is plenty to make the payload incompressible and unique
+		// per block, and is cheap enough not to bottleneck the writers.
+		x := seed ^ fileId*0x9e3779b97f4a7c15 ^ blockOffset | 1
+		for i := 0; i+8 <= len(payload); i += 8 {
+			x ^= x << 13
+			x ^= x >> 7
+			x ^= x << 17
+			binary.LittleEndian.PutUint64(payload[i:], x)
+		}
+
+		binary.LittleEndian.PutUint64(block[0:], verifyMagic)
+		binary.LittleEndian.PutUint64(block[8:], fileId)
+		binary.LittleEndian.PutUint64(block[16:], blockOffset)
+		binary.LittleEndian.PutUint64(block[24:], seed)
+		binary.LittleEndian.PutUint32(block[32:], crc32.Checksum(payload, castagnoli))
+		binary.LittleEndian.PutUint32(block[36:], 0)
+	}
+}
+
+// checkVerifyBlock returns a description of what is wrong with a block read
+// from the given offset, or an empty string if it is intact.
+func checkVerifyBlock(block []byte, fileId uint64, seed uint64, offset uint64) string {
+	if m := binary.LittleEndian.Uint64(block[0:]); m != verifyMagic {
+		return fmt.Sprintf("bad block header magic %#x", m)
+	}
+	if id := binary.LittleEndian.Uint64(block[8:]); id != fileId {
+		return fmt.Sprintf("block belongs to file id %#x, expected %#x", id, fileId)
+	}
+	if off := binary.LittleEndian.Uint64(block[16:]); off != offset {
+		return fmt.Sprintf("block was written at offset %d", off)
+	}
+	if sd := binary.LittleEndian.Uint64(block[24:]); sd != seed {
+		return fmt.Sprintf("block was written with seed %d, expected %d", sd, seed)
+	}
+	payload := block[verifyHeaderSize:]
+	if sum := crc32.Checksum(payload, castagnoli); sum != binary.LittleEndian.Uint32(block[32:]) {
+		return fmt.Sprintf("payload checksum %#x does not match header checksum %#x", sum, binary.LittleEndian.Uint32(block[32:]))
+	}
+	return ""
+}
+
+// blockVerifier is an io.Writer that checks a stream of data read from the
+// start of a file or object. Reads need not be block aligned. It is not safe
+// for concurrent use.
+type blockVerifier struct {
+	name    string
+	dataVip string
+	fileId  uint64
+	seed    uint64
+
+	offset     uint64
+	pending    []byte
+	mismatches uint64
+}
+
+func newBlockVerifier(name string, dataVip string, seed uint64) *blockVerifier {
+	return &blockVerifier{name: name, dataVip: dataVip, fileId: verifyFileId(name), seed: seed, pending: make([]byte, 0, verifyBlockSize)}
+}
+
+func (v *blockVerifier) check(block []byte) {
+	if problem := checkVerifyBlock(block, v.fileId, v.seed, v.offset); problem != "" {
+		v.mismatch(problem)
+	}
+	v.offset += verifyBlockSize
+}
+
+func (v *blockVerifier) mismatch(problem string) {
+	v.mismatches++
+	count := v.mismatches
+	if count <= maxReportedMismatches {
+		fmt.Printf("[error] Data mismatch reading %s from %s at offset %d: %s\n", v.name, v.dataVip, v.offset, problem)
+	}
+	if count == maxReportedMismatches+1 {
+		fmt.Printf("[error] Further data mismatches in %s not shown.\n", v.name)
+	}
+}
+
+func (v *blockVerifier) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		if len(v.pending) == 0 && len(p) >= verifyBlockSize {
+			v.check(p[:verifyBlockSize])
+			p = p[verifyBlockSize:]
+			continue
+		}
+		take := verifyBlockSize - len(v.pending)
+		if take > len(p) {
+			take = len(p)
+		}
+		v.pending = append(v.pending, p[:take]...)
+		p = p[take:]
+		if len(v.pending) == verifyBlockSize {
+			v.check(v.pending)
+			v.pending = v.pending[:0]
+		}
+	}
+	return written, nil
+}
+
+// EndOfStream marks the end of the file or object, so the next write is
+// checked as offset zero. A trailing partial block is a mismatch.
+func (v *blockVerifier) EndOfStream() {
+	if len(v.pending) > 0 {
+		v.mismatch(fmt.Sprintf("stream ends with a partial block of %d bytes", len(v.pending)))
+	}
+	v.Restart()
+}
+
+// Restart discards any partial block and expects the next write to be at
+// offset zero, for when a read is abandoned part way through.
+func (v *blockVerifier) Restart() {
+	v.offset = 0
+	v.pending = v.pending[:0]
+}
+
+func (v *blockVerifier) Mismatches() uint64 {
+	return v.mismatches
+}